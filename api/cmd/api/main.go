@@ -4,6 +4,8 @@ import (
 	"api/pkg/config"
 	"api/pkg/server"
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os/signal"
 	"syscall"
@@ -11,22 +13,26 @@ import (
 
 func main() {
 
-	cfg, err := config.Load("config/api.hcl")
+	opts := &config.Options{}
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
 
+	conf, err := opts.Load()
 	if err != nil {
-		log.Fatal("Failed to load config: ", err)
+		log.Fatalf("Failed to load config %s: %v", opts.ConfigFile, err)
 	}
-	conf, err := cfg.Parse()
-	if err != nil {
-		log.Fatal("Failed to parse config: ", err)
+	if opts.Validate {
+		fmt.Printf("Config %s is valid.\n", opts.ConfigFile)
+		return
 	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	srv := server.New(conf)
 
 	if err := srv.Run(ctx); err != nil {
-		log.Fatal("Failed to parse config: ", err)
+		log.Fatal("Failed to run server: ", err)
 	}
 
 }
@@ -1,4 +1,6 @@
 api {
-  address = "localhost:8081"
-  key      = "topsecret"
+  // PORT is set by the hosting platform
+  address = env("PORT", "") != "" ? ":${env("PORT")}" : "localhost:8081"
+  // e.g. file("/run/secrets/api_key")
+  key     = env("API_KEY")
 }
@@ -1,7 +1,8 @@
 package config
 
 import (
-	"os"
+	"hclconfig"
+	"path/filepath"
 
 	hcl "github.com/hashicorp/hcl/v2/hclsimple"
 )
@@ -9,7 +10,7 @@ import (
 // API configuration structure.
 type Config struct {
 	Address string
-	Key     string
+	Key     Secret
 }
 
 type hclConf struct {
@@ -20,9 +21,11 @@ type hclConf struct {
 }
 
 // Load reads and parses the HCL configuration file.
+// The env and file functions can be used in the file, see hclconfig.EvalContext.
+// Relative file() paths are resolved against the directory of the file.
 func Load(filename string) (*hclConf, error) {
 	cfg := &hclConf{}
-	if err := hcl.DecodeFile(filename, nil, cfg); err != nil {
+	if err := hcl.DecodeFile(filename, hclconfig.EvalContext(filepath.Dir(filename)), cfg); err != nil {
 		return nil, err
 	}
 
@@ -33,14 +36,12 @@ func Load(filename string) (*hclConf, error) {
 // Parse validates and converts the raw HCL configuration into a Config instance.
 func (rawconf *hclConf) Parse() (*Config, error) {
 
-	if rawconf.Api.Address == "" {
-		return nil, ErrInvalidAPIAddress
+	if rawconf.Api == nil {
+		return nil, ErrMissingAPI
 	}
 
-	port := os.Getenv("PORT")
-	if port != "" {
-		// for google cloud
-		rawconf.Api.Address = ":" + port
+	if rawconf.Api.Address == "" {
+		return nil, ErrInvalidAPIAddress
 	}
 
 	if rawconf.Api.Key == "" {
@@ -50,7 +51,7 @@ func (rawconf *hclConf) Parse() (*Config, error) {
 	return &Config{
 
 		Address: rawconf.Api.Address,
-		Key:     rawconf.Api.Key,
+		Key:     Secret(rawconf.Api.Key),
 	}, nil
 
 }
@@ -3,6 +3,7 @@ package config
 import "errors"
 
 var (
+	ErrMissingAPI        = errors.New("api config is missing")
 	ErrInvalidAPIKey     = errors.New("api key is invalid")
 	ErrInvalidAPIAddress = errors.New("api address is invalid")
 )
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"flag"
+	"os"
+)
+
+// DefaultConfigFile is the configuration file used when none is given.
+const DefaultConfigFile = "config/api.hcl"
+
+// Options holds the settings given on the command line or through environment variables.
+// Non-empty options take precedence over the configuration file.
+type Options struct {
+	ConfigFile string
+	Address    string
+
+	Validate bool // only validate the configuration and exit
+}
+
+// RegisterFlags defines the API server flags. The flag defaults are read from the environment.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	configFile := os.Getenv("API_CONFIG")
+	if configFile == "" {
+		configFile = DefaultConfigFile
+	}
+
+	fs.StringVar(&o.ConfigFile, "config", configFile, "path of the API configuration file (env API_CONFIG)")
+	fs.StringVar(&o.Address, "addr", os.Getenv("API_LISTEN_ADDRESS"), "listen address, overrides the api address (env API_LISTEN_ADDRESS)")
+	fs.BoolVar(&o.Validate, "validate", false, "validate the configuration and exit")
+}
+
+// Load reads and validates the configuration file, then applies the options.
+func (o *Options) Load() (*Config, error) {
+	rawconf, err := Load(o.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := rawconf.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// applied after parsing, so it takes precedence over PORT
+	if o.Address != "" {
+		conf.Address = o.Address
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,6 @@
+package config
+
+import "hclconfig"
+
+// Secret is a configuration value that must not be logged or dumped, see hclconfig.Secret.
+type Secret = hclconfig.Secret
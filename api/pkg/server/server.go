@@ -13,7 +13,7 @@ import (
 // Server represents the API server with its configuration.
 type Server struct {
 	address string
-	key     string
+	key     config.Secret
 }
 
 // New creates a new Server instance with the provided configuration.
@@ -83,5 +83,5 @@ func (s *Server) validateAuthorization(authHeader string) bool {
 		return false
 	}
 
-	return parts[1] == s.key
+	return parts[1] == s.key.Reveal()
 }
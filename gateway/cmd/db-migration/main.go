@@ -1,57 +1,129 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"flag"
 	"fmt"
+	"gateway/pkg/config"
+	"gateway/pkg/migrations"
+	"gateway/pkg/storage"
 	"log"
+	"os"
+	"strconv"
 	"time"
-
-	_ "modernc.org/sqlite"
 )
 
+const usage = `Usage: db-migration [flags] [command]
+
+Commands:
+  up         apply every pending migration (default)
+  down       revert the last applied migration
+  status     list the migrations and when they were applied
+  goto N     apply or revert migrations until the database is at version N
+
+Flags:
+`
+
 func main() {
-	dbPath := "limiter.db"
+	opts := &config.Options{}
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// the database file is resolved like in the gateway, so both use the same one
+	conf, err := opts.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config %s: %v", opts.ConfigFile, err)
+	}
+	if opts.Validate {
+		fmt.Printf("Config %s is valid.\n", opts.ConfigFile)
+		return
+	}
+
+	command := flag.Arg(0)
+	if command == "" {
+		command = "up"
+	}
+
+	ctx := context.Background()
 
-	db, err := sql.Open("sqlite", dbPath)
+	store, err := storage.Open(ctx, conf)
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
-	defer db.Close()
-
-	// Create users table with created_at
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS users (
-            id INTEGER PRIMARY KEY,
-            name TEXT NOT NULL,
-			quota FLOAT NOT NULL,
-            created_at DATETIME NOT NULL
-        )
-    `)
+	defer store.Close()
+
+	migrator, err := migrations.New(store)
+	if err != nil {
+		log.Fatal("Failed to load migrations:", err)
+	}
+
+	before, err := migrator.Current(ctx)
 	if err != nil {
-		log.Fatal("Failed to create table:", err)
+		log.Fatal("Failed to read the schema version:", err)
 	}
 
-	now := time.Now().Format(time.RFC3339)
+	var done []migrations.Migration
 
-	// Insert two users with creation date
-	_, err = db.Exec(`
-        INSERT OR REPLACE INTO users (id, name, quota, created_at) VALUES
-		(0, 'Admin', 10, ?),
-        (1, 'Ionel', 0.5, ?),
-        (2, 'Ionela', 1.0, ?)
-    `, now, now, now)
+	switch command {
+	case "up":
+		done, err = migrator.Up(ctx)
+
+	case "down":
+		done, err = migrator.Down(ctx)
+
+	case "goto":
+		version, convErr := strconv.Atoi(flag.Arg(1))
+		if flag.NArg() != 2 || convErr != nil {
+			log.Fatal("goto needs a version number")
+		}
+		done, err = migrator.Goto(ctx, version)
+
+	case "status":
+		if err := printStatus(ctx, migrator); err != nil {
+			log.Fatal("Failed to read the migrations:", err)
+		}
+		return
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	action := "Applied"
+	if len(done) > 0 && done[0].Version <= before {
+		action = "Reverted"
+	}
+	for _, m := range done {
+		fmt.Printf("%s %04d_%s\n", action, m.Version, m.Name)
+	}
+
+	if err != nil {
+		log.Fatal("Migration failed: ", err)
+	}
+
+	after, err := migrator.Current(ctx)
 	if err != nil {
-		log.Fatal("Failed to insert users:", err)
+		log.Fatal("Failed to read the schema version:", err)
 	}
+	fmt.Printf("Migration completed successfully. Schema version: %d.\n", after)
+}
 
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS request_count (
-		user_id INTEGER NOT NULL,
-		path TEXT NOT NULL,
-		window_start INTEGER NOT NULL,
-		count INTEGER NOT NULL,
-		PRIMARY KEY (user_id, path, window_start)
-	);`)
+func printStatus(ctx context.Context, migrator *migrations.Migrator) error {
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("Migration completed successfully.")
+	for _, s := range status {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d_%-24s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
 }
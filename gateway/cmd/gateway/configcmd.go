@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gateway/pkg/config"
+	"os"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// configCommand runs the "config" subcommands and returns the process exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gateway config check [-config file]")
+		fmt.Fprintln(os.Stderr, "       gateway config dump [-config file] [-format json|hcl]")
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		return configCheck(args[1:])
+	case "dump":
+		return configDump(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+	return 2
+}
+
+// configCheck reports every problem of the configuration file.
+// It exits with 1 if any problem, including a warning, is found.
+func configCheck(args []string) int {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	opts := &config.Options{}
+	opts.RegisterFlags(fs)
+	fs.Parse(args)
+
+	diags := config.Check(opts.ConfigFile)
+	if len(diags) == 0 {
+		fmt.Printf("Config %s is valid.\n", opts.ConfigFile)
+		return 0
+	}
+
+	errors, warnings := 0, 0
+	for _, diag := range diags {
+		severity := "warning"
+		if diag.Severity == hcl.DiagError {
+			severity = "error"
+			errors++
+		} else {
+			warnings++
+		}
+
+		position := opts.ConfigFile
+		if diag.Subject != nil {
+			position = fmt.Sprintf("%s:%d:%d", diag.Subject.Filename, diag.Subject.Start.Line, diag.Subject.Start.Column)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s: %s. %s\n", position, severity, diag.Summary, diag.Detail)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d error(s), %d warning(s)\n", opts.ConfigFile, errors, warnings)
+
+	return 1
+}
+
+// configDump prints the effective configuration, after defaults and overrides, with secrets redacted.
+func configDump(args []string) int {
+	fs := flag.NewFlagSet("config dump", flag.ExitOnError)
+	opts := &config.Options{}
+	opts.RegisterServerFlags(fs)
+	format := fs.String("format", "hcl", "output format, json or hcl")
+	fs.Parse(args)
+
+	conf, err := opts.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config %s: %v\n", opts.ConfigFile, err)
+		return 1
+	}
+
+	switch *format {
+	case "json":
+		data, err := conf.DumpJSON()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(data))
+	case "hcl":
+		os.Stdout.Write(conf.DumpHCL())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q, expected json or hcl\n", *format)
+		return 2
+	}
+
+	return 0
+}
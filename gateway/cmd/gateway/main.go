@@ -2,29 +2,68 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"gateway/pkg/config"
 	limiter "gateway/pkg/limiting-service"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 
-	cfg, err := config.Load("config/gateway.hcl")
-	if err != nil {
-		log.Fatal("Failed to load config: ", err)
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
 	}
-	conf, err := cfg.Parse()
+
+	opts := &config.Options{}
+	opts.RegisterServerFlags(flag.CommandLine)
+	flag.Parse()
+
+	conf, err := opts.Load()
 	if err != nil {
-		log.Fatal("Failed to parse config: ", err)
+		log.Fatalf("Failed to load config %s: %v", opts.ConfigFile, err)
+	}
+	if opts.Validate {
+		fmt.Printf("Config %s is valid.\n", opts.ConfigFile)
+		return
 	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 	limiter, err := limiter.New(ctx, conf)
+	if err != nil {
+		log.Fatal("Failed to start limiter: ", err)
+	}
+
+	go reloadOnSignal(ctx, limiter, opts)
+	if conf.WatchConfig {
+		go config.Watch(ctx, opts.ConfigFile, 2*time.Second, func() {
+			limiter.Reload(ctx, opts.Load)
+		})
+	}
 
 	if err := limiter.Run(ctx); err != nil {
 		limiter.Stop()
 	}
 
 }
+
+// reloadOnSignal reloads the configuration every time the process receives SIGHUP.
+func reloadOnSignal(ctx context.Context, lim *limiter.Limiter, opts *config.Options) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			lim.Reload(ctx, opts.Load)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gateway/pkg/config"
+	"gateway/pkg/migrations"
+	"gateway/pkg/storage"
+	userdata "gateway/pkg/user-data"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `Usage: users [flags] command [command flags]
+
+Commands:
+  import [-dry-run] [-format csv|json] file...
+             create or update the plans and users of the files
+  export [-format csv|json] [-plans] [-o file]
+             write the users, or the plans, to a file or to stdout
+
+Flags:
+`
+
+func main() {
+	opts := &config.Options{}
+	opts.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	conf, err := opts.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config %s: %v", opts.ConfigFile, err)
+	}
+	if opts.Validate {
+		fmt.Printf("Config %s is valid.\n", opts.ConfigFile)
+		return
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	store, err := storage.Open(ctx, conf)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer store.Close()
+
+	migrator, err := migrations.New(store)
+	if err != nil {
+		log.Fatal("Failed to load migrations:", err)
+	}
+	if err := migrator.Check(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "import":
+		err = importCommand(ctx, store, flag.Args()[1:])
+	case "export":
+		err = exportCommand(ctx, store, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importCommand(ctx context.Context, store *storage.Store, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "show the changes without writing them")
+	format := fs.String("format", "", "csv or json, detected from the file extension by default")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("import needs at least one file")
+	}
+
+	// the files are imported together, so users can refer to the plans of another file
+	data := &userdata.Data{}
+	for _, filename := range fs.Args() {
+		fileData, err := readFile(filename, *format)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		data.Plans = append(data.Plans, fileData.Plans...)
+		data.Users = append(data.Users, fileData.Users...)
+	}
+
+	changes, err := userdata.Import(ctx, store, data, *dryRun)
+	if err != nil {
+		return fmt.Errorf("import failed, nothing was written:\n%w", err)
+	}
+
+	counts := map[string]int{}
+	for _, c := range changes {
+		counts[c.Action]++
+
+		fields := ""
+		if len(c.Fields) > 0 {
+			fields = " (" + strings.Join(c.Fields, ", ") + ")"
+		}
+		fmt.Printf("%-9s %s %s%s\n", c.Action, c.Kind, c.Key, fields)
+	}
+
+	summary := fmt.Sprintf("%d created, %d updated, %d unchanged",
+		counts[userdata.ActionCreate], counts[userdata.ActionUpdate], counts[userdata.ActionUnchanged])
+	if *dryRun {
+		fmt.Printf("Dry run: %s. Nothing was written.\n", summary)
+	} else {
+		fmt.Printf("Import completed successfully: %s.\n", summary)
+	}
+	return nil
+}
+
+func exportCommand(ctx context.Context, store *storage.Store, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "csv or json, detected from the -o extension by default, json for stdout")
+	plans := fs.Bool("plans", false, "export the plans instead of the users, in csv format")
+	output := fs.String("o", "", "output file, stdout by default")
+	fs.Parse(args)
+
+	if *format == "" {
+		*format = formatOf(*output)
+		if *format == "" {
+			*format = "json"
+		}
+	}
+
+	data, err := userdata.Export(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch {
+	case *format == "json":
+		return userdata.WriteJSON(w, data)
+	case *format == "csv" && *plans:
+		return userdata.WritePlansCSV(w, data.Plans)
+	case *format == "csv":
+		return userdata.WriteUsersCSV(w, data.Users)
+	default:
+		return userdata.ErrUnknownFormat
+	}
+}
+
+func readFile(filename string, format string) (*userdata.Data, error) {
+	if format == "" {
+		format = formatOf(filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		return userdata.ReadJSON(f)
+	case "csv":
+		return userdata.ReadCSV(f)
+	default:
+		return nil, userdata.ErrUnknownFormat
+	}
+}
+
+// formatOf returns the format matching the extension of a file name, if any.
+func formatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".csv":
+		return "csv"
+	}
+	return ""
+}
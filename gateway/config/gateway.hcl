@@ -1,15 +1,69 @@
 
 gateway {
-  address               = "localhost:8080"
-  log_file               = "gateway.log"
-  db_file                = "limiter.db"
+  // PORT is set by the hosting platform
+  address                = env("PORT", "") != "" ? ":${env("PORT")}" : "localhost:8080"
+  // relative paths are relative to this file
+  log_file               = "../gateway.log"
+  log_level              = "info" // debug, info or error
   user_cache_ttl_minutes = 10
+  user_cache_size        = 10000
+
+  // sqlite or postgres, e.g. database_url = env("DATABASE_URL")
+  storage = "sqlite"
+  db_file = "../limiter.db"
+
+  negative_cache_ttl_seconds = 60
+  negative_cache_size        = 10000
+  user_changes_poll_seconds  = 2
+
+  // in-memory token buckets, per route
+  bucket_idle_timeout_seconds = 600
+  bucket_max_keys             = 100000
+
+  // saved every bucket_snapshot_interval_seconds and on shutdown, restored on startup
+  bucket_snapshot_file             = "../buckets.json"
+  bucket_snapshot_interval_seconds = 30
+
+  // fixed window counts are deleted window_retention_seconds after their window ended
+  window_cleanup_interval_seconds = 60
+  window_retention_seconds        = 60
+
+  // 0 writes the fixed window counts on every request, otherwise they are written in batches
+  window_flush_interval_ms = 0
+  window_flush_batch       = 100
+
+  auth_max_failures          = 10
+  auth_lockout_seconds       = 300
+
+  // clients behind these proxies are identified by X-Forwarded-For, e.g. ["10.0.0.0/8"]
+  trusted_proxies = []
+
+  // reload on SIGHUP is always enabled
+  watch_config = false
 
 }
 
 api {
-  address = "localhost:8081"
-  key      = "topsecret"
+  address = env("API_ADDRESS", "localhost:8081")
+  // e.g. file("/run/secrets/api_key")
+  key     = env("API_KEY")
+}
+
+// shared limiting state, for routes with backend = "redis"
+// redis {
+//   address = env("REDIS_ADDRESS", "localhost:6379")
+// }
+
+// limits shared with other gateways, for routes with backend = "cluster" or "ring"
+// cluster {
+//   address = "localhost:7946"
+//   peers   = ["gateway-2:7946"]
+//   key     = env("CLUSTER_KEY")
+// }
+
+admin {
+  address = env("ADMIN_ADDRESS", "localhost:8082")
+  key     = env("ADMIN_KEY")
 }
 
 routes {
@@ -23,4 +77,5 @@ routes {
   strategy    = "fixed_window"
   window_size = 10 // seconds
   sql_table    = "request_count"
+  on_error    = "deny" // or "allow", when the database fails
 }
\ No newline at end of file
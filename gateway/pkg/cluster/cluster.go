@@ -0,0 +1,272 @@
+// Package cluster shares rate limits between gateway replicas, without a shared store.
+//
+// With the cluster backend, each gateway keeps its own limiting state and periodically sends
+// the requests it accepted to its peers, which add them to their own state.
+//
+// With the ring backend, each user is owned by one gateway, chosen by consistent hashing among
+// the members that are up. The other gateways forward their requests to the owner.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"gateway/pkg/config"
+	errorlog "gateway/pkg/error-log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics holds the cluster counters, published under "cluster" at /debug/vars on the admin listener.
+var metrics = expvar.NewMap("cluster")
+
+const (
+	metricDeltasSent     = "deltas_sent"
+	metricDeltasReceived = "deltas_received"
+	metricSyncFailures   = "sync_failures"
+	metricForwards       = "forwards"
+	metricForwardErrors  = "forward_errors"
+	metricNotOwner       = "not_owner"
+	metricLocalDecisions = "local_decisions"
+	metricHandOffs       = "handoffs"
+	metricRingChanges    = "ring_changes"
+)
+
+// A peer is down once it missed downAfter syncs in a row.
+const downAfter = 3
+
+// Key identifies a counter shared by the cluster: the requests of a user for a path,
+// in the window starting at Window (Unix seconds), or 0 for strategies without windows.
+type Key struct {
+	Path   string `json:"path"`
+	UserId string `json:"user_id"`
+	Window int64  `json:"window,omitempty"`
+}
+
+// Delta is a change of a counter. Negative counts give requests back, e.g. after a top-up.
+type Delta struct {
+	Key
+	Count int `json:"count"`
+}
+
+// KeyState is the ring state of a key, handed off by its previous owner.
+// Only the fields of the route strategy are set.
+type KeyState struct {
+	Tokens     float64   `json:"tokens,omitempty"`
+	LastRefill time.Time `json:"last_refill"`
+	Window     int64     `json:"window,omitempty"`
+	Count      int       `json:"count,omitempty"`
+}
+
+// Handlers are the calls of the node into the limiting strategies of the routes.
+type Handlers struct {
+	// Merge adds the requests accepted by a peer, for the cluster backend.
+	Merge func(Delta)
+	// Accept decides on a request forwarded by a peer, for the ring backend.
+	// found is false if the path is not a ring route on this gateway.
+	Accept func(path string, userId string, rate float64) (accepted bool, found bool)
+	// TopUp and Reset change the state of a user owned by this gateway, for the ring backend.
+	// found is false if the path is not a ring route on this gateway.
+	TopUp func(path string, userId string, amount int) (found bool)
+	Reset func(path string, userId string) (found bool)
+	// HandOff returns the state of a key this gateway no longer owns, for the ring backend, or nil.
+	HandOff func(path string, userId string) *KeyState
+}
+
+// Node is the local member of the cluster.
+type Node struct {
+	id        string // random, so a restarted gateway is a new sender for its peers
+	self      string // URL of this gateway, as listed in the peers of the others
+	key       config.Secret
+	interval  time.Duration
+	tolerance float64
+	client    *http.Client
+	logger    *errorlog.Logger
+	handlers  Handlers
+
+	mu      sync.Mutex
+	peers   []*peer
+	lastSeq map[string]uint64 // sender id -> last batch applied
+
+	// ring of the members that are up, nil while this gateway doesn't see a majority of the cluster
+	ring      *ring
+	prevRing  *ring     // before the last change
+	epoch     uint64    // incremented on every change of the ring
+	changedAt time.Time // of the last change
+}
+
+type peer struct {
+	url            string
+	pending        map[Key]int // accepted requests not sent yet
+	inflight       *batch      // sent, not acknowledged yet
+	inflightCounts map[Key]int
+	seq            uint64 // last batch created
+	lastSeen       time.Time
+	lastErr        string
+}
+
+// New creates the local node of the cluster.
+// Until the first sync with its peers, the node has no ring, so ring routes are decided locally.
+func New(conf *config.Config, logger *errorlog.Logger, handlers Handlers) *Node {
+	n := &Node{
+		id:        newNodeId(),
+		self:      conf.Cluster.Advertise,
+		key:       conf.Cluster.Key,
+		interval:  conf.Cluster.SyncInterval,
+		tolerance: conf.Cluster.Tolerance,
+		client: &http.Client{
+			Timeout:   conf.Cluster.SyncInterval,
+			Transport: &http.Transport{MaxIdleConnsPerHost: 64},
+		},
+		logger:   logger,
+		handlers: handlers,
+		lastSeq:  map[string]uint64{},
+	}
+
+	// peers are assumed up until they miss their first syncs
+	now := time.Now()
+	for _, url := range conf.Cluster.Peers {
+		n.peers = append(n.peers, &peer{
+			url:      url,
+			pending:  map[Key]int{},
+			lastSeen: now,
+		})
+	}
+
+	return n
+}
+
+// Take decides whether one more request may be accepted for a counter, and records it if so.
+// used is the count known locally, including the requests of the peers received so far, and limit is the
+// count allowed across the cluster. A request is accepted if:
+//   - used stays below the share of the limit of the nodes that are up. While peers are down,
+//     the requests they may accept are set aside, so the limit holds during a partition.
+//   - the requests accepted locally and not yet acknowledged by every peer that is up stay below
+//     the share of this node of what is left of the limit, plus its share of limit × tolerance.
+//     Even if every node accepts its share before hearing from the others, the cluster accepts
+//     at most limit × (1 + tolerance) requests.
+func (n *Node) Take(key Key, used, limit float64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	nodes := float64(len(n.peers) + 1)
+	up := 1.0
+	unsynced := 0
+	for _, p := range n.peers {
+		if p.isUp(now, n.interval) {
+			up++
+			unsynced = max(unsynced, p.pending[key]+p.inflightCounts[key])
+		}
+	}
+
+	if used+1 > limit*up/nodes {
+		return false
+	}
+	synced := used - float64(unsynced)
+	if float64(unsynced+1) > max(1, math.Floor((limit-synced+limit*n.tolerance)/nodes)) {
+		return false
+	}
+
+	n.record(now, key, 1)
+	return true
+}
+
+// Record sends a change of a counter to the peers, e.g. requests given back to a user.
+func (n *Node) Record(key Key, count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.record(time.Now(), key, count)
+}
+
+// record queues a delta for the peers that are up. Peers that are down don't get
+// the deltas recorded meanwhile, as they would be out of date once the peer is back.
+// The caller must hold the lock.
+func (n *Node) record(now time.Time, key Key, count int) {
+	for _, p := range n.peers {
+		if p.isUp(now, n.interval) {
+			p.pending[key] += count
+		}
+	}
+}
+
+// Run sends the pending deltas to the peers every sync interval, until ctx is done.
+// Peers without pending deltas get an empty batch, which tells whether they are up.
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.sync(ctx)
+		}
+	}
+}
+
+// PeerStatus describes a peer, as seen by the local node.
+type PeerStatus struct {
+	URL       string    `json:"url"`
+	Up        bool      `json:"up"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastError string    `json:"last_error,omitempty"`
+	Pending   int       `json:"pending"` // counters waiting to be sent
+}
+
+// Status describes the local node and its peers.
+type Status struct {
+	Node      string       `json:"node"`
+	URL       string       `json:"url"`
+	Ring      []string     `json:"ring"` // members owning users, empty without a majority
+	Epoch     uint64       `json:"epoch"`
+	ChangedAt time.Time    `json:"changed_at"`
+	Peers     []PeerStatus `json:"peers"`
+}
+
+// Status returns the status of the local node and its peers.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]PeerStatus, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, PeerStatus{
+			URL:       p.url,
+			Up:        p.isUp(now, n.interval),
+			LastSeen:  p.lastSeen,
+			LastError: p.lastErr,
+			Pending:   len(p.pending) + len(p.inflightCounts),
+		})
+	}
+
+	status := Status{
+		Node:      n.id,
+		URL:       n.self,
+		Ring:      []string{},
+		Epoch:     n.epoch,
+		ChangedAt: n.changedAt,
+		Peers:     peers,
+	}
+	if n.ring != nil {
+		status.Ring = n.ring.members
+	}
+	return status
+}
+
+// isUp reports whether the peer answered one of its last syncs.
+func (p *peer) isUp(now time.Time, interval time.Duration) bool {
+	return now.Sub(p.lastSeen) <= downAfter*interval
+}
+
+func newNodeId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
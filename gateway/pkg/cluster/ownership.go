@@ -0,0 +1,145 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RingKey returns the key of a user on the ring.
+func RingKey(path string, userId string) string {
+	return path + ":" + userId
+}
+
+// Owner returns the member owning a key, and whether it is this gateway.
+// ok is false while this gateway doesn't see a majority of the cluster: it may be cut off from
+// the members owning the key, which still grant requests, so it must decide locally, see Share.
+func (n *Node) Owner(key string) (owner string, self bool, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ring == nil {
+		return "", false, false
+	}
+	owner = n.ring.owner(key)
+	return owner, owner == n.self, true
+}
+
+// LocalDecision counts a request decided locally, because this gateway has no ring or the owner is unreachable.
+func (n *Node) LocalDecision() {
+	metrics.Add(metricLocalDecisions, 1)
+}
+
+// Share returns the share of a limit a gateway may grant when it decides locally,
+// so the cluster doesn't grant more than the limit even if every member decides locally.
+func (n *Node) Share() float64 {
+	return 1 / float64(len(n.peers)+1)
+}
+
+// Claim tells whether the state this gateway keeps for a key it owns can be trusted.
+type Claim struct {
+	Epoch   uint64 // to store with the state
+	Trusted bool
+
+	// If the state can't be trusted, the previous owner of the key, if it is up, to ask for its state
+	// with HandOff. Otherwise, the previous owner may have granted requests until Since.
+	From  string
+	Since time.Time
+}
+
+// Claim checks the state of a key owned by this gateway. epoch is the epoch stored with the state,
+// and found tells whether there is a state. The state can be trusted if it is from the current epoch,
+// or if this gateway already owned the key before the last change of the ring. Otherwise, another
+// member owned the key meanwhile, and the state is out of date, if any.
+func (n *Node) Claim(key string, epoch uint64, found bool) Claim {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	claim := Claim{Epoch: n.epoch, Trusted: true}
+	if found && epoch == n.epoch {
+		return claim
+	}
+
+	prev := ""
+	if n.prevRing != nil {
+		prev = n.prevRing.owner(key)
+	}
+	if prev == n.self && (!found || epoch+1 == n.epoch) {
+		return claim
+	}
+
+	claim.Trusted = false
+	claim.Since = n.changedAt
+	if prev != "" && prev != n.self && n.isUp(prev) {
+		claim.From = prev
+	}
+	return claim
+}
+
+// updateRing rebuilds the ring from the members that are up, after a sync.
+// The caller must not hold the lock.
+func (n *Node) updateRing() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	members := []string{n.self}
+	for _, p := range n.peers {
+		if p.isUp(now, n.interval) {
+			members = append(members, p.url)
+		}
+	}
+
+	var next *ring
+	if 2*len(members) > len(n.peers)+1 {
+		next = newRing(members)
+	}
+
+	switch {
+	case next == nil && n.ring == nil:
+		return
+	case next != nil && n.ring != nil && strings.Join(next.members, " ") == strings.Join(n.ring.members, " "):
+		return
+	}
+
+	if n.ring == nil && n.epoch == 0 && next != nil {
+		// first ring since the start: the keys of this gateway were owned by the others meanwhile
+		n.prevRing = nil
+		if len(next.members) > 1 {
+			n.prevRing = newRing(without(next.members, n.self))
+		}
+	} else {
+		n.prevRing = n.ring
+	}
+	n.ring = next
+	n.epoch++
+	n.changedAt = now
+	metrics.Add(metricRingChanges, 1)
+
+	if next == nil {
+		n.logger.WriteError(fmt.Errorf("cluster: no majority of the members is up, ring routes are decided locally"))
+	} else {
+		n.logger.WriteInfo(fmt.Sprintf("cluster: ring changed to [%s], epoch %d", strings.Join(next.members, " "), n.epoch))
+	}
+}
+
+// isUp reports whether a member is up. The caller must hold the lock.
+func (n *Node) isUp(url string) bool {
+	now := time.Now()
+	for _, p := range n.peers {
+		if p.url == url {
+			return p.isUp(now, n.interval)
+		}
+	}
+	return false
+}
+
+func without(members []string, member string) []string {
+	others := []string{}
+	for _, m := range members {
+		if m != member {
+			others = append(others, m)
+		}
+	}
+	return others
+}
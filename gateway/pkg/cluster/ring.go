@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Each member is placed on the ring this many times, so the keys spread evenly.
+const virtualNodes = 64
+
+// ring assigns each key to one member with consistent hashing: when a member joins or leaves,
+// only the keys it owns move.
+type ring struct {
+	members []string // sorted
+	hashes  []uint64 // sorted positions of the virtual nodes
+	owners  map[uint64]string
+}
+
+func newRing(members []string) *ring {
+	r := &ring{
+		members: slices.Sorted(slices.Values(members)),
+		owners:  map[uint64]string{},
+	}
+
+	for _, member := range r.members {
+		for i := range virtualNodes {
+			h := hash(member + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = member
+		}
+	}
+	slices.Sort(r.hashes)
+
+	return r
+}
+
+// owner returns the member owning a key: the first virtual node at or after the key hash.
+func (r *ring) owner(key string) string {
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// hash is FNV-1a, with a final mix so that similar strings, like the virtual nodes of a member, spread evenly.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
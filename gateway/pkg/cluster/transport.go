@@ -0,0 +1,334 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotOwner is returned when a peer doesn't own the user of a forwarded call: its ring differs from the ring of this gateway.
+	ErrNotOwner = errors.New("cluster: the peer doesn't own the user")
+	// ErrPeerFailed is returned when a peer can't be reached, or fails to handle a forwarded call.
+	ErrPeerFailed = errors.New("cluster: peer failed")
+)
+
+// batch is the body of a sync request. Batches are numbered per sender, so a batch
+// sent again after a lost response is only applied once.
+type batch struct {
+	Node   string  `json:"node"`
+	Seq    uint64  `json:"seq"`
+	Deltas []Delta `json:"deltas"`
+}
+
+// Handler returns the handler of the cluster listener. It requires the cluster key as a bearer token.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/sync", n.handleSync)
+	mux.HandleFunc("POST /cluster/accept", n.handleAccept)
+	mux.HandleFunc("POST /cluster/handoff", n.handleHandOff)
+	mux.HandleFunc("POST /cluster/topup", n.handleTopUp)
+	mux.HandleFunc("POST /cluster/reset", n.handleReset)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(n.key.Reveal())) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (n *Node) handleSync(w http.ResponseWriter, r *http.Request) {
+	var b batch
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "invalid batch", http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	apply := b.Seq > n.lastSeq[b.Node]
+	if apply {
+		n.lastSeq[b.Node] = b.Seq
+	}
+	n.mu.Unlock()
+
+	// Merge takes the strategy locks, which are held while calling Take, so not under n.mu
+	if apply {
+		for _, d := range b.Deltas {
+			n.handlers.Merge(d)
+		}
+		metrics.Add(metricDeltasReceived, int64(len(b.Deltas)))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sync sends a batch to every peer, in parallel.
+func (n *Node) sync(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range n.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.syncPeer(ctx, p)
+		}()
+	}
+	wg.Wait()
+
+	n.updateRing()
+}
+
+// syncPeer sends the batch waiting for an acknowledgement, or else the pending deltas, to a peer.
+func (n *Node) syncPeer(ctx context.Context, p *peer) {
+	n.mu.Lock()
+	if p.inflight == nil {
+		b := &batch{Node: n.id, Seq: p.seq}
+		if len(p.pending) > 0 {
+			p.seq++
+			b.Seq = p.seq
+			for key, count := range p.pending {
+				b.Deltas = append(b.Deltas, Delta{Key: key, Count: count})
+			}
+			p.inflightCounts = p.pending
+			p.pending = map[Key]int{}
+		}
+		p.inflight = b
+	}
+	b := p.inflight
+	n.mu.Unlock()
+
+	err := n.send(ctx, p.url, b)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err != nil {
+		metrics.Add(metricSyncFailures, 1)
+		if p.lastErr == "" {
+			n.logger.WriteError(fmt.Errorf("cluster: sync with %s failed: %w", p.url, err))
+		}
+		p.lastErr = err.Error()
+		if !p.isUp(time.Now(), n.interval) {
+			// the peer won't get these deltas, see record
+			p.inflight = nil
+			p.inflightCounts = nil
+			p.pending = map[Key]int{}
+		}
+		return
+	}
+
+	if p.lastErr != "" {
+		n.logger.WriteInfo(fmt.Sprintf("cluster: sync with %s recovered", p.url))
+	}
+	metrics.Add(metricDeltasSent, int64(len(b.Deltas)))
+	p.inflight = nil
+	p.inflightCounts = nil
+	p.lastSeen = time.Now()
+	p.lastErr = ""
+}
+
+func (n *Node) send(ctx context.Context, url string, b *batch) error {
+	return n.call(ctx, url+"/cluster/sync", b, nil)
+}
+
+// call posts a JSON request to a peer and decodes the response into resp, unless it is nil or there is no content.
+func (n *Node) call(ctx context.Context, url string, body any, resp any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.key.Reveal())
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		return nil
+	case res.StatusCode == http.StatusConflict:
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%w: %s", ErrNotOwner, strings.TrimSpace(string(message)))
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s", res.Status)
+	case resp != nil:
+		return json.NewDecoder(res.Body).Decode(resp)
+	}
+	return nil
+}
+
+// acceptRequest is the body of a call forwarded to the owner of a user.
+// Epoch is the epoch of the ring of the sender, reported when the receiver doesn't own the user.
+type acceptRequest struct {
+	Path   string  `json:"path"`
+	UserId string  `json:"user_id"`
+	Rate   float64 `json:"rate,omitempty"`
+	Amount int     `json:"amount,omitempty"`
+	Epoch  uint64  `json:"epoch,omitempty"`
+}
+
+type acceptResponse struct {
+	Accepted bool `json:"accepted"`
+}
+
+func (n *Node) handleAccept(w http.ResponseWriter, r *http.Request) {
+	var req acceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !n.owns(w, req) {
+		return
+	}
+
+	accepted, found := n.handlers.Accept(req.Path, req.UserId, req.Rate)
+	if !found {
+		http.Error(w, "not a ring route", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(acceptResponse{Accepted: accepted})
+}
+
+func (n *Node) handleTopUp(w http.ResponseWriter, r *http.Request) {
+	var req acceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount <= 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !n.owns(w, req) {
+		return
+	}
+	if !n.handlers.TopUp(req.Path, req.UserId, req.Amount) {
+		http.Error(w, "not a ring route", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *Node) handleReset(w http.ResponseWriter, r *http.Request) {
+	var req acceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !n.owns(w, req) {
+		return
+	}
+	if !n.handlers.Reset(req.Path, req.UserId) {
+		http.Error(w, "not a ring route", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// owns reports whether this gateway owns the user of a forwarded call, according to its own ring.
+// Otherwise, it responds with 409, so the sender falls back: the rings differ until the next syncs.
+// The epochs of the rings are only reported, as each gateway numbers its own ring changes.
+func (n *Node) owns(w http.ResponseWriter, req acceptRequest) bool {
+	_, self, ok := n.Owner(RingKey(req.Path, req.UserId))
+	if ok && self {
+		return true
+	}
+
+	metrics.Add(metricNotOwner, 1)
+	n.mu.Lock()
+	epoch := n.epoch
+	n.mu.Unlock()
+
+	http.Error(w, fmt.Sprintf("%s doesn't own %s at epoch %d, sender at epoch %d", n.self, RingKey(req.Path, req.UserId), epoch, req.Epoch), http.StatusConflict)
+	return false
+}
+
+func (n *Node) handleHandOff(w http.ResponseWriter, r *http.Request) {
+	var req acceptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	state := n.handlers.HandOff(req.Path, req.UserId)
+	if state == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// Forward asks the owner of a user to decide on a request.
+func (n *Node) Forward(owner string, path string, userId string, rate float64) (bool, error) {
+	metrics.Add(metricForwards, 1)
+
+	req := n.forwardRequest(path, userId)
+	req.Rate = rate
+
+	var resp acceptResponse
+	err := n.call(context.Background(), owner+"/cluster/accept", req, &resp)
+	if err != nil {
+		metrics.Add(metricForwardErrors, 1)
+		return false, fmt.Errorf("%w: forward to %s failed: %w", ErrPeerFailed, owner, err)
+	}
+	return resp.Accepted, nil
+}
+
+// ForwardTopUp asks the owner of a user to add tokens to its bucket, or lower its window count.
+func (n *Node) ForwardTopUp(owner string, path string, userId string, amount int) error {
+	req := n.forwardRequest(path, userId)
+	req.Amount = amount
+	if err := n.call(context.Background(), owner+"/cluster/topup", req, nil); err != nil {
+		return fmt.Errorf("%w: top-up on %s failed: %w", ErrPeerFailed, owner, err)
+	}
+	return nil
+}
+
+// ForwardReset asks the owner of a user to clear its limiting state.
+func (n *Node) ForwardReset(owner string, path string, userId string) error {
+	if err := n.call(context.Background(), owner+"/cluster/reset", n.forwardRequest(path, userId), nil); err != nil {
+		return fmt.Errorf("%w: reset on %s failed: %w", ErrPeerFailed, owner, err)
+	}
+	return nil
+}
+
+// forwardRequest returns the body of a call forwarded to the owner of a user, with the current epoch.
+func (n *Node) forwardRequest(path string, userId string) acceptRequest {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return acceptRequest{Path: path, UserId: userId, Epoch: n.epoch}
+}
+
+// HandOff asks the previous owner of a user for its state. It returns nil if the previous owner has none.
+func (n *Node) HandOff(from string, path string, userId string) (*KeyState, error) {
+	metrics.Add(metricHandOffs, 1)
+
+	var state *KeyState
+	err := n.call(context.Background(), from+"/cluster/handoff", acceptRequest{Path: path, UserId: userId}, &state)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: handoff from %s failed: %w", from, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	errorlog "gateway/pkg/error-log"
+	"hclconfig"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// Check reads the configuration file and reports every problem found, with its position in the file.
+// Unlike Parse, it doesn't stop at the first problem. Attributes that have no effect are reported as warnings.
+func Check(filename string) hcl.Diagnostics {
+	parser := hclparse.NewParser()
+
+	file, diags := parser.ParseHCLFile(filename)
+	if diags.HasErrors() {
+		return diags
+	}
+
+	// file() paths are relative to the configuration file, as in Load
+	ctx := hclconfig.EvalContext(filepath.Dir(filename))
+	rawconf := &hclConf{}
+	diags = append(diags, gohcl.DecodeBody(file.Body, ctx, rawconf)...)
+
+	body, ok := file.Body.(*hclsyntax.Body)
+	if !ok {
+		return diags
+	}
+
+	blocks := map[string][]*hclsyntax.Block{}
+	for _, block := range body.Blocks {
+		blocks[block.Type] = append(blocks[block.Type], block)
+	}
+
+	for _, blockType := range []string{"gateway", "api"} {
+		if len(blocks[blockType]) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing " + blockType + " block",
+				Detail:   fmt.Sprintf("The configuration must contain a %s block.", blockType),
+				Subject:  &hcl.Range{Filename: filename, Start: hcl.InitialPos, End: hcl.InitialPos},
+			})
+		}
+	}
+
+	gatewayAddress := ""
+	for _, block := range blocks["gateway"] {
+		diags = append(diags, checkGateway(ctx, block)...)
+		decodeAttr(ctx, block, "address", &gatewayAddress)
+	}
+	for _, block := range blocks["api"] {
+		diags = append(diags, checkNotEmpty(ctx, block, "address", "key")...)
+	}
+	for _, block := range blocks["admin"] {
+		diags = append(diags, checkNotEmpty(ctx, block, "address", "key")...)
+
+		var address string
+		if attr := decodeAttr(ctx, block, "address", &address); attr != nil && address == gatewayAddress {
+			diags = append(diags, attrError(attr, "Invalid admin address", "The admin address must differ from the gateway address."))
+		}
+	}
+
+	for _, block := range blocks["redis"] {
+		diags = append(diags, checkNotEmpty(ctx, block, "address")...)
+
+		var db int
+		if attr := decodeAttr(ctx, block, "db", &db); attr != nil && db < 0 {
+			diags = append(diags, attrError(attr, "Invalid db", "db must be >= 0."))
+		}
+	}
+
+	for _, block := range blocks["cluster"] {
+		diags = append(diags, checkNotEmpty(ctx, block, "address", "advertise", "key")...)
+
+		var address string
+		if attr := decodeAttr(ctx, block, "address", &address); attr != nil && address == gatewayAddress {
+			diags = append(diags, attrError(attr, "Invalid cluster address", "The cluster address must differ from the gateway address."))
+		}
+
+		var peers []string
+		if attr := decodeAttr(ctx, block, "peers", &peers); attr != nil && len(peers) == 0 {
+			diags = append(diags, attrError(attr, "Missing peers", "peers must list the other gateways of the cluster."))
+		}
+
+		var interval int
+		if attr := decodeAttr(ctx, block, "sync_interval_ms", &interval); attr != nil && interval <= 0 {
+			diags = append(diags, attrError(attr, "Invalid sync_interval_ms", "sync_interval_ms must be > 0."))
+		}
+
+		var tolerance float64
+		if attr := decodeAttr(ctx, block, "tolerance", &tolerance); attr != nil && (tolerance < 0 || tolerance > 1) {
+			diags = append(diags, attrError(attr, "Invalid tolerance", "tolerance must be between 0 and 1."))
+		}
+	}
+
+	// the routes are validated as Parse does, positioned at their blocks;
+	// the routes that fail to decode are already reported
+	rawconf.Routes = nil
+	for _, block := range blocks["routes"] {
+		route := hclRoute{block: block}
+		if !gohcl.DecodeBody(block.Body, ctx, &route).HasErrors() {
+			rawconf.Routes = append(rawconf.Routes, route)
+		}
+	}
+	_, routeDiags := rawconf.checkRoutes()
+	diags = append(diags, routeDiags...)
+
+	// anything the checks above missed, positioned at the block it is about
+	if !diags.HasErrors() {
+		if _, err := rawconf.Parse(); err != nil {
+			subject := &hcl.Range{Filename: filename, Start: hcl.InitialPos, End: hcl.InitialPos}
+			if found := blocks[errorBlock(err)]; len(found) > 0 {
+				subject = found[0].DefRange().Ptr()
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid configuration",
+				Detail:   err.Error(),
+				Subject:  subject,
+			})
+		}
+	}
+
+	return diags
+}
+
+// errorBlocks are the blocks that the errors of Parse are about, other than the gateway block.
+var errorBlocks = map[string][]error{
+	"api":     {ErrInvalidAPIKey, ErrInvalidAPIAddress},
+	"admin":   {ErrInvalidAdminKey, ErrInvalidAdminAddress},
+	"redis":   {ErrInvalidRedisAddress},
+	"cluster": {ErrInvalidClusterAddress, ErrInvalidClusterKey, ErrMissingPeers, ErrInvalidPeer, ErrSyncInterval, ErrTolerance},
+}
+
+// errorBlock returns the type of the block an error of Parse is about.
+func errorBlock(err error) string {
+	for blockType, blockErrs := range errorBlocks {
+		for _, blockErr := range blockErrs {
+			if errors.Is(err, blockErr) {
+				return blockType
+			}
+		}
+	}
+	return "gateway"
+}
+
+func checkGateway(ctx *hcl.EvalContext, block *hclsyntax.Block) hcl.Diagnostics {
+	diags := checkNotEmpty(ctx, block, "address", "log_file", "db_file", "database_url")
+
+	storage := "sqlite"
+	storageAttr := decodeAttr(ctx, block, "storage", &storage)
+	switch storage {
+	case "sqlite":
+		if _, found := block.Body.Attributes["db_file"]; !found {
+			diags = append(diags, blockError(block, "Missing db_file", "db_file is required for the sqlite storage."))
+		}
+		if attr := block.Body.Attributes["database_url"]; attr != nil {
+			diags = append(diags, attrWarning(attr, "Unused attribute", "database_url is only used by the postgres storage."))
+		}
+	case "postgres":
+		if _, found := block.Body.Attributes["database_url"]; !found {
+			diags = append(diags, blockError(block, "Missing database_url", "database_url is required for the postgres storage."))
+		}
+		if attr := block.Body.Attributes["db_file"]; attr != nil {
+			diags = append(diags, attrWarning(attr, "Unused attribute", "db_file is only used by the sqlite storage."))
+		}
+	default:
+		diags = append(diags, attrError(storageAttr, "Invalid storage", fmt.Sprintf("The storage %q must be sqlite or postgres.", storage)))
+	}
+
+	for _, name := range []string{"user_cache_ttl_minutes", "user_cache_size", "negative_cache_ttl_seconds", "negative_cache_size", "user_changes_poll_seconds", "bucket_idle_timeout_seconds", "bucket_max_keys", "bucket_snapshot_interval_seconds", "window_cleanup_interval_seconds", "window_retention_seconds", "window_flush_interval_ms", "window_flush_batch", "auth_max_failures", "auth_lockout_seconds"} {
+		var value int
+		if attr := decodeAttr(ctx, block, name, &value); attr != nil && value < 0 {
+			diags = append(diags, attrError(attr, "Invalid "+name, name+" must be >= 0."))
+		}
+	}
+
+	var proxies []string
+	if attr := decodeAttr(ctx, block, "trusted_proxies", &proxies); attr != nil {
+		for _, proxy := range proxies {
+			if _, err := parseTrustedProxy(proxy); err != nil {
+				diags = append(diags, attrError(attr, "Invalid trusted_proxies", fmt.Sprintf("%q is not an IP address or a CIDR range.", proxy)))
+			}
+		}
+	}
+
+	var logLevel string
+	if attr := decodeAttr(ctx, block, "log_level", &logLevel); attr != nil {
+		if _, err := errorlog.ParseLevel(logLevel); err != nil {
+			diags = append(diags, attrError(attr, "Invalid log_level", err.Error()+"."))
+		}
+	}
+
+	return diags
+}
+
+// checkNotEmpty reports the given string attributes of a block that are set to an empty string.
+// Missing attributes are already reported when decoding.
+func checkNotEmpty(ctx *hcl.EvalContext, block *hclsyntax.Block, names ...string) hcl.Diagnostics {
+	diags := hcl.Diagnostics{}
+	for _, name := range names {
+		var value string
+		if attr := decodeAttr(ctx, block, name, &value); attr != nil && value == "" {
+			diags = append(diags, attrError(attr, "Empty "+name, name+" must not be empty."))
+		}
+	}
+	return diags
+}
+
+// decodeAttr decodes a block attribute into target and returns it.
+// It returns nil if the attribute is missing or can't be decoded, which is already reported when decoding the body.
+func decodeAttr(ctx *hcl.EvalContext, block *hclsyntax.Block, name string, target any) *hclsyntax.Attribute {
+	attr, found := block.Body.Attributes[name]
+	if !found {
+		return nil
+	}
+	if diags := gohcl.DecodeExpression(attr.Expr, ctx, target); diags.HasErrors() {
+		return nil
+	}
+	return attr
+}
+
+func attrError(attr *hclsyntax.Attribute, summary, detail string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  summary,
+		Detail:   detail,
+		Subject:  attr.Expr.Range().Ptr(),
+		Context:  attr.SrcRange.Ptr(),
+	}
+}
+
+func attrWarning(attr *hclsyntax.Attribute, summary, detail string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagWarning,
+		Summary:  summary,
+		Detail:   detail,
+		Subject:  attr.NameRange.Ptr(),
+		Context:  attr.SrcRange.Ptr(),
+	}
+}
+
+func blockError(block *hclsyntax.Block, summary, detail string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  summary,
+		Detail:   detail,
+		Subject:  block.DefRange().Ptr(),
+	}
+}
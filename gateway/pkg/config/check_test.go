@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+const checkBase = `gateway {
+  address  = "localhost:8090"
+  log_file = "gateway.log"
+  db_file  = "gateway.db"
+}
+
+api {
+  address = "localhost:8081"
+  key     = "key"
+}
+`
+
+// writeConfig writes the base configuration followed by extra blocks, starting at line 12.
+func writeConfig(t *testing.T, blocks string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "gateway.hcl")
+	if err := os.WriteFile(filename, []byte(checkBase+"\n"+blocks), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCheckReportsParseRouteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks string
+		err    error
+		line   int
+	}{
+		{"path", "routes {\n  path = \"foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n}\n", ErrRoutePath, 13},
+		{"strategy", "routes {\n  path = \"/foo\"\n  strategy = \"leaky_bucket\"\n}\n", ErrInvalidStrategy, 14},
+		{"missing capacity", "routes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n}\n", ErrTokenCapacity, 12},
+		{"window_size", "routes {\n  path = \"/foo\"\n  strategy = \"fixed_window\"\n  window_size = 0\n}\n", ErrWindowSize, 15},
+		{"backend", "routes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n  backend = \"sql\"\n}\n", ErrInvalidBackend, 16},
+		{"sql_table", "routes {\n  path = \"/foo\"\n  strategy = \"fixed_window\"\n  window_size = 1\n  sql_table = \"a b\"\n}\n", ErrSqlTable, 16},
+		{"on_error", "routes {\n  path = \"/foo\"\n  strategy = \"fixed_window\"\n  window_size = 1\n  on_error = \"maybe\"\n}\n", ErrInvalidOnError, 16},
+		{"redis block", "routes {\n  path = \"/foo\"\n  strategy = \"sliding_window\"\n  window_size = 1\n}\n", ErrMissingRedis, 12},
+		{"cluster block", "routes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n  backend = \"ring\"\n}\n", ErrMissingCluster, 16},
+		{"duplicate", "routes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n}\nroutes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n}\n", ErrDuplicateRoute, 18},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := writeConfig(t, test.blocks)
+
+			rawconf, err := Load(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := rawconf.Parse(); !errors.Is(err, test.err) {
+				t.Errorf("Parse returned %v, want %v", err, test.err)
+			}
+
+			diags := Check(filename)
+			errs := hcl.Diagnostics{}
+			for _, diag := range diags {
+				if diag.Severity == hcl.DiagError {
+					errs = append(errs, diag)
+				}
+			}
+			if len(errs) != 1 {
+				t.Fatalf("Check reported %d errors, want 1: %v", len(errs), diags)
+			}
+			if err, _ := errs[0].Extra.(error); !errors.Is(err, test.err) {
+				t.Errorf("Check reported %v, want %v", errs[0], test.err)
+			}
+			if errs[0].Subject == nil || errs[0].Subject.Start.Line != test.line {
+				t.Errorf("Check reported %v at %v, want line %d", errs[0].Summary, errs[0].Subject, test.line)
+			}
+		})
+	}
+}
+
+func TestCheckWarnsAboutUnusedRouteAttributes(t *testing.T) {
+	filename := writeConfig(t, "routes {\n  path = \"/foo\"\n  strategy = \"token_bucket\"\n  capacity = 1\n  window_size = 5\n  limit = 3\n}\n")
+
+	diags := Check(filename)
+	if diags.HasErrors() {
+		t.Fatalf("Check reported errors: %v", diags)
+	}
+	lines := []int{}
+	for _, diag := range diags {
+		if diag.Subject == nil {
+			t.Fatalf("warning %q has no position", diag.Summary)
+		}
+		lines = append(lines, diag.Subject.Start.Line)
+	}
+	slices.Sort(lines)
+	if !slices.Equal(lines, []int{16, 17}) {
+		t.Errorf("Check warned at lines %v, want 16 and 17: %v", lines, diags)
+	}
+}
+
+func TestCheckPositionsOtherParseErrors(t *testing.T) {
+	filename := writeConfig(t, "cluster {\n  address = \"localhost:9000\"\n  key = \"key\"\n  peers = [\"localhost:9000\"]\n}\n")
+
+	diags := Check(filename)
+	if len(diags) != 1 {
+		t.Fatalf("Check reported %d diagnostics, want 1: %v", len(diags), diags)
+	}
+	if diags[0].Subject == nil || diags[0].Subject.Start.Line != 12 {
+		t.Errorf("Check reported %v at %v, want the cluster block at line 12", diags[0].Detail, diags[0].Subject)
+	}
+}
@@ -1,45 +1,134 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	errorlog "gateway/pkg/error-log"
+	"hclconfig"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	hcl "github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 )
 
 // Gateway configuration structure.
 type Config struct {
 	Address string
-	Routes  map[string]routeConfig
+	Routes  map[string]RouteConfig
 
-	LogFile string
-	DBFile  string
+	LogFile  string
+	LogLevel errorlog.Level
 
-	UserCacheTTL time.Duration // minutes
+	Storage     string // sqlite or postgres
+	DBFile      string // sqlite only
+	DatabaseURL Secret // postgres only
 
-	Api *apiConfig
+	UserCacheTTL      time.Duration // minutes
+	UserCacheSize     int           // maximum number of cached users
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int           // maximum number of cached unknown user ids
+	UserChangesPoll   time.Duration // how often the user changes made by other gateways are polled
+
+	BucketIdleTimeout time.Duration // full in-memory token buckets unused for this long are dropped
+	BucketMaxKeys     int           // maximum number of in-memory token buckets per route
+
+	BucketSnapshotFile     string // empty if the in-memory token buckets are not saved
+	BucketSnapshotInterval time.Duration
+
+	WindowCleanupInterval time.Duration // how often the expired fixed window counts are deleted
+	WindowRetention       time.Duration // how long the fixed window counts are kept after their window ended
+
+	WindowFlushInterval time.Duration // 0 if the fixed window counts are written on every request
+	WindowFlushBatch    int           // requests counted in memory per window before they are written
+
+	AuthMaxFailures int
+	AuthLockout     time.Duration
+	TrustedProxies  []netip.Prefix // client IPs are read from X-Forwarded-For on requests from these addresses
+
+	WatchConfig bool // reload when the config file changes
+
+	Api     *apiConfig
+	Admin   *adminConfig   // nil if the admin listener is disabled
+	Redis   *redisConfig   // nil if the redis backend is not configured
+	Cluster *clusterConfig // nil if the gateway doesn't run as part of a cluster
+
+	Source Source
+}
+
+// Source identifies the configuration file a Config was loaded from.
+type Source struct {
+	File     string    `json:"file"`
+	Hash     string    `json:"sha256"`
+	LoadedAt time.Time `json:"loaded_at"`
 }
 
 type apiConfig struct {
 	Address string
-	Key     string
+	Key     Secret
+}
+
+type adminConfig struct {
+	Address string
+	Key     Secret
 }
 
-type routeConfig struct {
-	Strategy     string
-	BucketCap    int // for token bucket
-	WindowLength int // for fixed window, seconds
-	SqlTable     string
+type redisConfig struct {
+	Address   string
+	Password  Secret
+	DB        int
+	KeyPrefix string
+}
+
+type clusterConfig struct {
+	Address      string   // listen address for the traffic between peers
+	Advertise    string   // base URL of this gateway, as listed in the peers of the others
+	Peers        []string // base URLs of the other gateways
+	Key          Secret
+	SyncInterval time.Duration
+	Tolerance    float64 // fraction of a limit the cluster may exceed
 }
 
 type hclConf struct {
+	source Source
+
 	Gateway *struct {
-		Address      string `hcl:"address"`
-		LogFile      string `hcl:"log_file"`
-		DBFile       string `hcl:"db_file"`
-		UserCacheTTL int    `hcl:"user_cache_ttl_minutes,optional"`
+		Address       string `hcl:"address"`
+		LogFile       string `hcl:"log_file"`
+		LogLevel      string `hcl:"log_level,optional"`
+		UserCacheTTL  int    `hcl:"user_cache_ttl_minutes,optional"`
+		UserCacheSize int    `hcl:"user_cache_size,optional"`
+
+		Storage     string `hcl:"storage,optional"`
+		DBFile      string `hcl:"db_file,optional"`
+		DatabaseURL string `hcl:"database_url,optional"`
+
+		NegativeCacheTTL  int `hcl:"negative_cache_ttl_seconds,optional"`
+		NegativeCacheSize int `hcl:"negative_cache_size,optional"`
+		UserChangesPoll   int `hcl:"user_changes_poll_seconds,optional"`
+		BucketIdleTimeout int `hcl:"bucket_idle_timeout_seconds,optional"`
+		BucketMaxKeys     int `hcl:"bucket_max_keys,optional"`
+
+		BucketSnapshotFile     string `hcl:"bucket_snapshot_file,optional"`
+		BucketSnapshotInterval int    `hcl:"bucket_snapshot_interval_seconds,optional"`
+
+		WindowCleanupInterval int `hcl:"window_cleanup_interval_seconds,optional"`
+		WindowRetention       int `hcl:"window_retention_seconds,optional"`
+
+		WindowFlushInterval int `hcl:"window_flush_interval_ms,optional"`
+		WindowFlushBatch    int `hcl:"window_flush_batch,optional"`
+
+		AuthMaxFailures    int `hcl:"auth_max_failures,optional"`
+		AuthLockoutSeconds int `hcl:"auth_lockout_seconds,optional"`
+
+		TrustedProxies []string `hcl:"trusted_proxies,optional"`
+
+		WatchConfig bool `hcl:"watch_config,optional"`
 	} `hcl:"gateway,block"`
 
 	Api *struct {
@@ -47,22 +136,62 @@ type hclConf struct {
 		Key     string `hcl:"key"`
 	} `hcl:"api,block"`
 
+	Admin *struct {
+		Address string `hcl:"address"`
+		Key     string `hcl:"key"`
+	} `hcl:"admin,block"`
+
+	Redis *struct {
+		Address   string `hcl:"address"`
+		Password  string `hcl:"password,optional"`
+		DB        int    `hcl:"db,optional"`
+		KeyPrefix string `hcl:"key_prefix,optional"`
+	} `hcl:"redis,block"`
+
+	Cluster *struct {
+		Address        string   `hcl:"address"`
+		Advertise      string   `hcl:"advertise,optional"`
+		Peers          []string `hcl:"peers"`
+		Key            string   `hcl:"key"`
+		SyncIntervalMs int      `hcl:"sync_interval_ms,optional"`
+		Tolerance      *float64 `hcl:"tolerance,optional"`
+	} `hcl:"cluster,block"`
+
 	Routes []hclRoute `hcl:"routes,block"`
 }
 
 type hclRoute struct {
 	Path       string `hcl:"path"`
 	Strategy   string `hcl:"strategy"`
+	Backend    string `hcl:"backend,optional"`
 	Capacity   int    `hcl:"capacity,optional"`
 	Limit      int    `hcl:"limit,optional"`
 	WindowSize int    `hcl:"window_size,optional"`
 	SqlTable   string `hcl:"sql_table,optional"`
+	OnError    string `hcl:"on_error,optional"`
+
+	block *hclsyntax.Block // set by Check, to position the diagnostics
 }
 
 // Load reads and parses the HCL configuration file.
+// The env and file functions can be used in the file, see hclconfig.EvalContext.
+// Relative file() paths are resolved against the directory of the file, like db_file and log_file.
 func Load(filename string) (*hclConf, error) {
-	cfg := &hclConf{}
-	if err := hcl.DecodeFile(filename, nil, cfg); err != nil {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(src)
+	cfg := &hclConf{
+		source: Source{
+			File:     filename,
+			Hash:     hex.EncodeToString(hash[:]),
+			LoadedAt: time.Now(),
+		},
+	}
+
+	if err := hcl.Decode(filename, src, hclconfig.EvalContext(filepath.Dir(filename)), cfg); err != nil {
 		return nil, err
 	}
 
@@ -73,13 +202,10 @@ func Load(filename string) (*hclConf, error) {
 // Parse validates and converts the raw HCL configuration into a Config instance.
 func (rawconf *hclConf) Parse() (*Config, error) {
 	if rawconf.Gateway == nil {
-		return nil, ErrInvalidAPIAddress
+		return nil, ErrMissingGateway
 	}
-
-	port := os.Getenv("PORT")
-	if port != "" {
-		// for google cloud
-		rawconf.Gateway.Address = ":" + port
+	if rawconf.Api == nil {
+		return nil, ErrMissingAPI
 	}
 
 	if rawconf.Gateway.Address == "" {
@@ -90,19 +216,121 @@ func (rawconf *hclConf) Parse() (*Config, error) {
 		return nil, ErrInvalidLogFile
 	}
 
-	if rawconf.Gateway.DBFile == "" {
-		return nil, ErrInvalidDBFile
+	switch rawconf.Gateway.Storage {
+	case "", "sqlite":
+		rawconf.Gateway.Storage = "sqlite"
+		if rawconf.Gateway.DBFile == "" {
+			return nil, ErrInvalidDBFile
+		}
+	case "postgres":
+		if rawconf.Gateway.DatabaseURL == "" {
+			return nil, ErrInvalidDatabaseURL
+		}
+	default:
+		return nil, ErrInvalidStorage
+	}
+
+	logLevel, err := errorlog.ParseLevel(rawconf.Gateway.LogLevel)
+	if err != nil {
+		return nil, err
 	}
 
 	if rawconf.Gateway.UserCacheTTL == 0 {
 		rawconf.Gateway.UserCacheTTL = 10 // minutes
 	}
 
-	envApiAddr := os.Getenv("API_ADDRESS")
-	if envApiAddr != "" {
-		// for google cloud
-		rawconf.Api.Address = envApiAddr
+	if rawconf.Gateway.UserCacheSize < 0 {
+		return nil, ErrUserCacheSize
+	}
+	if rawconf.Gateway.UserCacheSize == 0 {
+		rawconf.Gateway.UserCacheSize = 10000
+	}
+
+	if rawconf.Gateway.NegativeCacheTTL < 0 {
+		return nil, ErrNegativeCacheTTL
+	}
+	if rawconf.Gateway.NegativeCacheTTL == 0 {
+		rawconf.Gateway.NegativeCacheTTL = 60 // seconds
+	}
+
+	if rawconf.Gateway.NegativeCacheSize < 0 {
+		return nil, ErrNegativeCacheSize
+	}
+	if rawconf.Gateway.NegativeCacheSize == 0 {
+		rawconf.Gateway.NegativeCacheSize = 10000
+	}
+
+	if rawconf.Gateway.UserChangesPoll < 0 {
+		return nil, ErrUserChangesPoll
+	}
+	if rawconf.Gateway.UserChangesPoll == 0 {
+		rawconf.Gateway.UserChangesPoll = 2 // seconds
+	}
+
+	if rawconf.Gateway.BucketIdleTimeout < 0 {
+		return nil, ErrBucketIdleTimeout
+	}
+	if rawconf.Gateway.BucketIdleTimeout == 0 {
+		rawconf.Gateway.BucketIdleTimeout = 600 // seconds
+	}
+
+	if rawconf.Gateway.BucketMaxKeys < 0 {
+		return nil, ErrBucketMaxKeys
+	}
+	if rawconf.Gateway.BucketMaxKeys == 0 {
+		rawconf.Gateway.BucketMaxKeys = 100000
+	}
+
+	if rawconf.Gateway.BucketSnapshotInterval < 0 {
+		return nil, ErrBucketSnapshotInterval
+	}
+	if rawconf.Gateway.BucketSnapshotInterval == 0 {
+		rawconf.Gateway.BucketSnapshotInterval = 30 // seconds
+	}
+
+	if rawconf.Gateway.WindowCleanupInterval < 0 {
+		return nil, ErrWindowCleanupInterval
+	}
+	if rawconf.Gateway.WindowCleanupInterval == 0 {
+		rawconf.Gateway.WindowCleanupInterval = 60 // seconds
+	}
+
+	if rawconf.Gateway.WindowRetention < 0 {
+		return nil, ErrWindowRetention
+	}
+	if rawconf.Gateway.WindowRetention == 0 {
+		rawconf.Gateway.WindowRetention = 60 // seconds
+	}
+
+	if rawconf.Gateway.WindowFlushInterval < 0 {
+		return nil, ErrWindowFlushInterval
+	}
+	if rawconf.Gateway.WindowFlushBatch < 0 {
+		return nil, ErrWindowFlushBatch
+	}
+	if rawconf.Gateway.WindowFlushBatch == 0 {
+		rawconf.Gateway.WindowFlushBatch = 100
+	}
+
+	if rawconf.Gateway.AuthMaxFailures < 0 {
+		return nil, ErrAuthMaxFailures
+	}
+	if rawconf.Gateway.AuthMaxFailures == 0 {
+		rawconf.Gateway.AuthMaxFailures = 10
+	}
+
+	if rawconf.Gateway.AuthLockoutSeconds < 0 {
+		return nil, ErrAuthLockout
+	}
+	if rawconf.Gateway.AuthLockoutSeconds == 0 {
+		rawconf.Gateway.AuthLockoutSeconds = 300
 	}
+
+	trustedProxies, err := parseTrustedProxies(rawconf.Gateway.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	if !strings.HasPrefix(rawconf.Api.Address, "http") {
 		rawconf.Api.Address = "http://" + rawconf.Api.Address
 	}
@@ -115,59 +343,202 @@ func (rawconf *hclConf) Parse() (*Config, error) {
 	}
 
 	conf := &Config{
-		Address:      rawconf.Gateway.Address,
-		LogFile:      rawconf.Gateway.LogFile,
-		UserCacheTTL: time.Duration(rawconf.Gateway.UserCacheTTL),
-		DBFile:       rawconf.Gateway.DBFile,
+		Address:       rawconf.Gateway.Address,
+		LogFile:       rawconf.resolvePath(rawconf.Gateway.LogFile),
+		LogLevel:      logLevel,
+		UserCacheTTL:  time.Duration(rawconf.Gateway.UserCacheTTL),
+		UserCacheSize: rawconf.Gateway.UserCacheSize,
+
+		Storage:     rawconf.Gateway.Storage,
+		DBFile:      rawconf.resolvePath(rawconf.Gateway.DBFile),
+		DatabaseURL: Secret(rawconf.Gateway.DatabaseURL),
+
+		NegativeCacheTTL:  time.Duration(rawconf.Gateway.NegativeCacheTTL) * time.Second,
+		NegativeCacheSize: rawconf.Gateway.NegativeCacheSize,
+		UserChangesPoll:   time.Duration(rawconf.Gateway.UserChangesPoll) * time.Second,
+		BucketIdleTimeout: time.Duration(rawconf.Gateway.BucketIdleTimeout) * time.Second,
+		BucketMaxKeys:     rawconf.Gateway.BucketMaxKeys,
+
+		BucketSnapshotFile:     rawconf.resolvePath(rawconf.Gateway.BucketSnapshotFile),
+		BucketSnapshotInterval: time.Duration(rawconf.Gateway.BucketSnapshotInterval) * time.Second,
+
+		WindowCleanupInterval: time.Duration(rawconf.Gateway.WindowCleanupInterval) * time.Second,
+		WindowRetention:       time.Duration(rawconf.Gateway.WindowRetention) * time.Second,
+
+		WindowFlushInterval: time.Duration(rawconf.Gateway.WindowFlushInterval) * time.Millisecond,
+		WindowFlushBatch:    rawconf.Gateway.WindowFlushBatch,
+
+		AuthMaxFailures: rawconf.Gateway.AuthMaxFailures,
+		AuthLockout:     time.Duration(rawconf.Gateway.AuthLockoutSeconds) * time.Second,
+		TrustedProxies:  trustedProxies,
+		WatchConfig:     rawconf.Gateway.WatchConfig,
+
+		Source: rawconf.source,
 
 		Api: &apiConfig{
 			Address: rawconf.Api.Address,
-			Key:     rawconf.Api.Key,
+			Key:     Secret(rawconf.Api.Key),
 		},
 	}
 
-	if len(rawconf.Routes) == 0 {
-		return conf, nil
+	if rawconf.Admin != nil {
+		if rawconf.Admin.Address == "" || rawconf.Admin.Address == conf.Address {
+			return nil, ErrInvalidAdminAddress
+		}
+		if rawconf.Admin.Key == "" {
+			return nil, ErrInvalidAdminKey
+		}
+
+		conf.Admin = &adminConfig{
+			Address: rawconf.Admin.Address,
+			Key:     Secret(rawconf.Admin.Key),
+		}
 	}
-	routeLimits := map[string]routeConfig{}
 
-	for _, route := range rawconf.Routes {
-		if route.Path == "" {
-			continue
+	if rawconf.Redis != nil {
+		if rawconf.Redis.Address == "" {
+			return nil, ErrInvalidRedisAddress
+		}
+		if rawconf.Redis.KeyPrefix == "" {
+			rawconf.Redis.KeyPrefix = "gateway"
 		}
 
-		switch route.Strategy {
-		case "token_bucket":
-			if route.Capacity <= 0 {
-				return nil, fmt.Errorf("%w %s", ErrTokenCapacity, route.Path)
-			}
-
-			routeLimits[route.Path] = routeConfig{
-				Strategy:  route.Strategy,
-				BucketCap: route.Capacity,
-			}
-
-		case "fixed_window":
-
-			if route.WindowSize == 0 {
-				return nil, fmt.Errorf("%w %s", ErrWindowSize, route.Path)
-			}
-			if route.SqlTable == "" {
-				route.SqlTable = "request_count"
-			}
-			routeLimits[route.Path] = routeConfig{
-				Strategy:     route.Strategy,
-				WindowLength: route.WindowSize,
-				SqlTable:     route.SqlTable,
-			}
-		default:
-			return nil, fmt.Errorf("invalid strategy for route %s", route.Path)
+		conf.Redis = &redisConfig{
+			Address:   rawconf.Redis.Address,
+			Password:  Secret(rawconf.Redis.Password),
+			DB:        rawconf.Redis.DB,
+			KeyPrefix: rawconf.Redis.KeyPrefix,
 		}
 	}
 
-	if len(routeLimits) > 0 {
-		conf.Routes = routeLimits
+	if rawconf.Cluster != nil {
+		cluster, err := rawconf.parseCluster(conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.Cluster = cluster
 	}
 
+	routes, err := rawconf.parseRoutes()
+	if err != nil {
+		return nil, err
+	}
+	conf.Routes = routes
+
 	return conf, nil
 }
+
+func (rawconf *hclConf) parseCluster(conf *Config) (*clusterConfig, error) {
+	raw := rawconf.Cluster
+
+	listeners := []string{conf.Address}
+	if conf.Admin != nil {
+		listeners = append(listeners, conf.Admin.Address)
+	}
+	if raw.Address == "" || slices.Contains(listeners, raw.Address) {
+		return nil, ErrInvalidClusterAddress
+	}
+	if raw.Key == "" {
+		return nil, ErrInvalidClusterKey
+	}
+	if len(raw.Peers) == 0 {
+		return nil, ErrMissingPeers
+	}
+
+	advertise := raw.Advertise
+	if advertise == "" {
+		advertise = raw.Address
+	}
+	advertise = peerURL(advertise)
+
+	peers := make([]string, 0, len(raw.Peers))
+	for _, peer := range raw.Peers {
+		if peer == "" {
+			return nil, ErrInvalidPeer
+		}
+		peer = peerURL(peer)
+		if slices.Contains(peers, peer) {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidPeer, peer)
+		}
+		if peer == advertise {
+			return nil, fmt.Errorf("%w: %s is this gateway", ErrInvalidPeer, peer)
+		}
+		peers = append(peers, peer)
+	}
+
+	if raw.SyncIntervalMs < 0 {
+		return nil, ErrSyncInterval
+	}
+	if raw.SyncIntervalMs == 0 {
+		raw.SyncIntervalMs = 250
+	}
+
+	tolerance := 0.1
+	if raw.Tolerance != nil {
+		tolerance = *raw.Tolerance
+	}
+	if tolerance < 0 || tolerance > 1 {
+		return nil, ErrTolerance
+	}
+
+	return &clusterConfig{
+		Address:      raw.Address,
+		Advertise:    advertise,
+		Peers:        peers,
+		Key:          Secret(raw.Key),
+		SyncInterval: time.Duration(raw.SyncIntervalMs) * time.Millisecond,
+		Tolerance:    tolerance,
+	}, nil
+}
+
+// Equal reports whether two cluster configurations are the same. Both may be nil.
+func (c *clusterConfig) Equal(other *clusterConfig) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	return c.Address == other.Address && c.Advertise == other.Advertise && slices.Equal(c.Peers, other.Peers) && c.Key == other.Key &&
+		c.SyncInterval == other.SyncInterval && c.Tolerance == other.Tolerance
+}
+
+// resolvePath returns a path set in the configuration file, relative to the directory of the file,
+// so the gateway opens the same files whatever its working directory.
+// Absolute paths and the in-memory sqlite database are kept as is.
+func (rawconf *hclConf) resolvePath(path string) string {
+	if path == "" || path == ":memory:" || filepath.IsAbs(path) || rawconf.source.File == "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(rawconf.source.File), path)
+}
+
+// peerURL returns the base URL of a cluster member given as an address or a URL.
+func peerURL(address string) string {
+	if !strings.HasPrefix(address, "http") {
+		return "http://" + address
+	}
+	return address
+}
+
+// parseTrustedProxies parses the trusted proxies, given as IP addresses or CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, proxy)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parseTrustedProxy parses an IP address, as a single address range, or a CIDR range.
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(proxy); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
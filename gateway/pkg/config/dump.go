@@ -0,0 +1,244 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// dumpConf is the effective configuration, laid out like the configuration file.
+// Defaults and overrides are applied and secrets are redacted.
+type dumpConf struct {
+	Source  *Source       `json:"source"`
+	Gateway dumpGateway   `json:"gateway"`
+	Api     dumpListener  `json:"api"`
+	Admin   *dumpListener `json:"admin"`
+	Redis   *dumpRedis    `json:"redis"`
+	Cluster *dumpCluster  `json:"cluster"`
+	Routes  []dumpRoute   `json:"routes"`
+}
+
+type dumpGateway struct {
+	Address                string   `hcl:"address" json:"address"`
+	LogFile                string   `hcl:"log_file" json:"log_file"`
+	LogLevel               string   `hcl:"log_level" json:"log_level"`
+	Storage                string   `hcl:"storage" json:"storage"`
+	DBFile                 string   `hcl:"db_file,optional" json:"db_file,omitempty"`
+	DatabaseURL            string   `hcl:"database_url,optional" json:"database_url,omitempty"`
+	UserCacheTTL           int      `hcl:"user_cache_ttl_minutes" json:"user_cache_ttl_minutes"`
+	UserCacheSize          int      `hcl:"user_cache_size" json:"user_cache_size"`
+	NegativeCacheTTL       int      `hcl:"negative_cache_ttl_seconds" json:"negative_cache_ttl_seconds"`
+	NegativeCacheSize      int      `hcl:"negative_cache_size" json:"negative_cache_size"`
+	UserChangesPoll        int      `hcl:"user_changes_poll_seconds" json:"user_changes_poll_seconds"`
+	BucketIdleTimeout      int      `hcl:"bucket_idle_timeout_seconds" json:"bucket_idle_timeout_seconds"`
+	BucketMaxKeys          int      `hcl:"bucket_max_keys" json:"bucket_max_keys"`
+	BucketSnapshotFile     string   `hcl:"bucket_snapshot_file,optional" json:"bucket_snapshot_file,omitempty"`
+	BucketSnapshotInterval int      `hcl:"bucket_snapshot_interval_seconds" json:"bucket_snapshot_interval_seconds"`
+	WindowCleanupInterval  int      `hcl:"window_cleanup_interval_seconds" json:"window_cleanup_interval_seconds"`
+	WindowRetention        int      `hcl:"window_retention_seconds" json:"window_retention_seconds"`
+	WindowFlushInterval    int      `hcl:"window_flush_interval_ms" json:"window_flush_interval_ms"`
+	WindowFlushBatch       int      `hcl:"window_flush_batch" json:"window_flush_batch"`
+	AuthMaxFailures        int      `hcl:"auth_max_failures" json:"auth_max_failures"`
+	AuthLockoutSeconds     int      `hcl:"auth_lockout_seconds" json:"auth_lockout_seconds"`
+	TrustedProxies         []string `hcl:"trusted_proxies" json:"trusted_proxies"`
+	WatchConfig            bool     `hcl:"watch_config" json:"watch_config"`
+}
+
+type dumpListener struct {
+	Address string `hcl:"address" json:"address"`
+	Key     string `hcl:"key" json:"key"`
+}
+
+type dumpRedis struct {
+	Address   string `hcl:"address" json:"address"`
+	Password  string `hcl:"password,optional" json:"password,omitempty"`
+	DB        int    `hcl:"db" json:"db"`
+	KeyPrefix string `hcl:"key_prefix" json:"key_prefix"`
+}
+
+type dumpCluster struct {
+	Address        string   `hcl:"address" json:"address"`
+	Advertise      string   `hcl:"advertise" json:"advertise"`
+	Peers          []string `hcl:"peers" json:"peers"`
+	Key            string   `hcl:"key" json:"key"`
+	SyncIntervalMs int      `hcl:"sync_interval_ms" json:"sync_interval_ms"`
+	Tolerance      float64  `hcl:"tolerance" json:"tolerance"`
+}
+
+type dumpRoute struct {
+	Path       string `hcl:"path" json:"path"`
+	Strategy   string `hcl:"strategy" json:"strategy"`
+	Backend    string `hcl:"backend" json:"backend"`
+	Capacity   int    `hcl:"capacity,optional" json:"capacity,omitempty"`
+	WindowSize int    `hcl:"window_size,optional" json:"window_size,omitempty"`
+	SqlTable   string `hcl:"sql_table,optional" json:"sql_table,omitempty"`
+	OnError    string `hcl:"on_error" json:"on_error"`
+}
+
+// DumpJSON returns the effective configuration as JSON, with secrets redacted.
+// It includes the file the configuration was loaded from, its hash and the load time.
+func (c *Config) DumpJSON() ([]byte, error) {
+	return json.MarshalIndent(c.dump(), "", "  ")
+}
+
+// DumpHCL returns the effective configuration in the configuration file format, with secrets redacted.
+// The file the configuration was loaded from, its hash and the load time are written as a comment.
+func (c *Config) DumpHCL() []byte {
+	dump := c.dump()
+
+	file := hclwrite.NewEmptyFile()
+	body := file.Body()
+
+	gateway := gohcl.EncodeAsBlock(dump.Gateway, "gateway")
+	// settings of the other storage
+	if dump.Gateway.DBFile == "" {
+		gateway.Body().RemoveAttribute("db_file")
+	}
+	if dump.Gateway.DatabaseURL == "" {
+		gateway.Body().RemoveAttribute("database_url")
+	}
+	body.AppendBlock(gateway)
+	body.AppendNewline()
+	body.AppendBlock(gohcl.EncodeAsBlock(dump.Api, "api"))
+	if dump.Admin != nil {
+		body.AppendNewline()
+		body.AppendBlock(gohcl.EncodeAsBlock(dump.Admin, "admin"))
+	}
+	if dump.Redis != nil {
+		redis := gohcl.EncodeAsBlock(dump.Redis, "redis")
+		if dump.Redis.Password == "" {
+			redis.Body().RemoveAttribute("password")
+		}
+		body.AppendNewline()
+		body.AppendBlock(redis)
+	}
+	if dump.Cluster != nil {
+		body.AppendNewline()
+		body.AppendBlock(gohcl.EncodeAsBlock(dump.Cluster, "cluster"))
+	}
+
+	for _, route := range dump.Routes {
+		block := gohcl.EncodeAsBlock(route, "routes")
+		// settings of other strategies
+		if route.Capacity == 0 {
+			block.Body().RemoveAttribute("capacity")
+		}
+		if route.WindowSize == 0 {
+			block.Body().RemoveAttribute("window_size")
+		}
+		if route.SqlTable == "" {
+			block.Body().RemoveAttribute("sql_table")
+		}
+
+		body.AppendNewline()
+		body.AppendBlock(block)
+	}
+
+	header := fmt.Sprintf("// file: %s\n// sha256: %s\n// loaded_at: %s\n\n",
+		c.Source.File, c.Source.Hash, c.Source.LoadedAt.Format(time.RFC3339))
+
+	return append([]byte(header), file.Bytes()...)
+}
+
+func (c *Config) dump() *dumpConf {
+	dump := &dumpConf{
+		Source: &c.Source,
+		Gateway: dumpGateway{
+			Address:                c.Address,
+			LogFile:                c.LogFile,
+			LogLevel:               c.LogLevel.String(),
+			Storage:                c.Storage,
+			DBFile:                 c.DBFile,
+			UserCacheTTL:           int(c.UserCacheTTL),
+			UserCacheSize:          c.UserCacheSize,
+			NegativeCacheTTL:       int(c.NegativeCacheTTL / time.Second),
+			NegativeCacheSize:      c.NegativeCacheSize,
+			UserChangesPoll:        int(c.UserChangesPoll / time.Second),
+			BucketIdleTimeout:      int(c.BucketIdleTimeout / time.Second),
+			BucketMaxKeys:          c.BucketMaxKeys,
+			BucketSnapshotFile:     c.BucketSnapshotFile,
+			BucketSnapshotInterval: int(c.BucketSnapshotInterval / time.Second),
+			WindowCleanupInterval:  int(c.WindowCleanupInterval / time.Second),
+			WindowRetention:        int(c.WindowRetention / time.Second),
+			WindowFlushInterval:    int(c.WindowFlushInterval / time.Millisecond),
+			WindowFlushBatch:       c.WindowFlushBatch,
+			AuthMaxFailures:        c.AuthMaxFailures,
+			AuthLockoutSeconds:     int(c.AuthLockout / time.Second),
+			TrustedProxies:         trustedProxies(c.TrustedProxies),
+			WatchConfig:            c.WatchConfig,
+		},
+		Api: dumpListener{
+			Address: c.Api.Address,
+			Key:     c.Api.Key.String(),
+		},
+		Routes: []dumpRoute{},
+	}
+
+	if c.DatabaseURL != "" {
+		dump.Gateway.DatabaseURL = c.DatabaseURL.String()
+	}
+
+	if c.Admin != nil {
+		dump.Admin = &dumpListener{
+			Address: c.Admin.Address,
+			Key:     c.Admin.Key.String(),
+		}
+	}
+
+	if c.Redis != nil {
+		dump.Redis = &dumpRedis{
+			Address:   c.Redis.Address,
+			DB:        c.Redis.DB,
+			KeyPrefix: c.Redis.KeyPrefix,
+		}
+		if c.Redis.Password != "" {
+			dump.Redis.Password = c.Redis.Password.String()
+		}
+	}
+
+	if c.Cluster != nil {
+		dump.Cluster = &dumpCluster{
+			Address:        c.Cluster.Address,
+			Advertise:      c.Cluster.Advertise,
+			Peers:          c.Cluster.Peers,
+			Key:            c.Cluster.Key.String(),
+			SyncIntervalMs: int(c.Cluster.SyncInterval / time.Millisecond),
+			Tolerance:      c.Cluster.Tolerance,
+		}
+	}
+
+	for path, route := range c.Routes {
+		dump.Routes = append(dump.Routes, dumpRoute{
+			Path:       path,
+			Strategy:   route.Strategy,
+			Backend:    route.Backend,
+			Capacity:   route.BucketCap,
+			WindowSize: route.WindowLength,
+			SqlTable:   route.SqlTable,
+			OnError:    route.OnError,
+		})
+	}
+	sort.Slice(dump.Routes, func(i, j int) bool {
+		return dump.Routes[i].Path < dump.Routes[j].Path
+	})
+
+	return dump
+}
+
+// trustedProxies returns the trusted proxies as written in the configuration.
+func trustedProxies(prefixes []netip.Prefix) []string {
+	proxies := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix.IsSingleIP() {
+			proxies = append(proxies, prefix.Addr().String())
+		} else {
+			proxies = append(proxies, prefix.String())
+		}
+	}
+	return proxies
+}
@@ -3,14 +3,52 @@ package config
 import "errors"
 
 var (
-	ErrMissingGateway        = errors.New("gateway config is missing")
-	ErrMissingGatewayAddress = errors.New("gateway address is missing")
-	ErrInvalidLogFile        = errors.New("log_file is invalid")
-	ErrInvalidDBFile         = errors.New("db_file is invalid")
+	ErrMissingGateway         = errors.New("gateway config is missing")
+	ErrMissingGatewayAddress  = errors.New("gateway address is missing")
+	ErrInvalidLogFile         = errors.New("log_file is invalid")
+	ErrInvalidDBFile          = errors.New("db_file is invalid")
+	ErrInvalidStorage         = errors.New("storage must be sqlite or postgres")
+	ErrInvalidDatabaseURL     = errors.New("database_url is required for the postgres storage")
+	ErrUserCacheSize          = errors.New("user_cache_size must be >= 0")
+	ErrNegativeCacheTTL       = errors.New("negative_cache_ttl_seconds must be >= 0")
+	ErrNegativeCacheSize      = errors.New("negative_cache_size must be >= 0")
+	ErrUserChangesPoll        = errors.New("user_changes_poll_seconds must be >= 0")
+	ErrBucketIdleTimeout      = errors.New("bucket_idle_timeout_seconds must be >= 0")
+	ErrBucketMaxKeys          = errors.New("bucket_max_keys must be >= 0")
+	ErrBucketSnapshotInterval = errors.New("bucket_snapshot_interval_seconds must be >= 0")
+	ErrWindowCleanupInterval  = errors.New("window_cleanup_interval_seconds must be >= 0")
+	ErrWindowRetention        = errors.New("window_retention_seconds must be >= 0")
+	ErrWindowFlushInterval    = errors.New("window_flush_interval_ms must be >= 0")
+	ErrWindowFlushBatch       = errors.New("window_flush_batch must be >= 0")
+	ErrAuthMaxFailures        = errors.New("auth_max_failures must be >= 0")
+	ErrAuthLockout            = errors.New("auth_lockout_seconds must be >= 0")
+	ErrInvalidTrustedProxy    = errors.New("trusted_proxies must list IP addresses or CIDR ranges")
 
+	ErrMissingAPI        = errors.New("api config is missing")
 	ErrInvalidAPIKey     = errors.New("api key is invalid")
 	ErrInvalidAPIAddress = errors.New("api address is invalid")
 
+	ErrInvalidAdminKey     = errors.New("admin key is invalid")
+	ErrInvalidAdminAddress = errors.New("admin address is invalid, it must differ from the gateway address")
+
+	ErrInvalidRedisAddress = errors.New("redis address is invalid")
+	ErrMissingRedis        = errors.New("redis config is missing, it is required by the redis backend of route")
+
+	ErrInvalidClusterAddress = errors.New("cluster address is invalid, it must differ from the gateway and admin addresses")
+	ErrInvalidClusterKey     = errors.New("cluster key is invalid")
+	ErrMissingPeers          = errors.New("cluster peers are missing")
+	ErrInvalidPeer           = errors.New("cluster peer is invalid")
+	ErrSyncInterval          = errors.New("sync_interval_ms must be > 0")
+	ErrTolerance             = errors.New("tolerance must be between 0 and 1")
+	ErrMissingCluster        = errors.New("cluster config is missing, it is required by the cluster and ring backends of route")
+
 	ErrTokenCapacity = errors.New("capacity must be > 0 for route")
 	ErrWindowSize    = errors.New("window_size must be > 0 for route")
+
+	ErrRoutePath       = errors.New("path must start with / for route")
+	ErrSqlTable        = errors.New("sql_table must be a valid SQL identifier for route")
+	ErrInvalidStrategy = errors.New("invalid strategy for route")
+	ErrInvalidBackend  = errors.New("invalid backend for route")
+	ErrInvalidOnError  = errors.New("on_error must be allow or deny for route")
+	ErrDuplicateRoute  = errors.New("duplicate path for route")
 )
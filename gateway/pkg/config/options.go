@@ -0,0 +1,81 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// DefaultConfigFile is the configuration file used when none is given.
+const DefaultConfigFile = "config/gateway.hcl"
+
+// Options holds the settings given on the command line or through environment variables.
+// Non-empty options take precedence over the configuration file.
+type Options struct {
+	ConfigFile string
+	DBFile     string
+	Address    string
+	LogLevel   string
+
+	Validate bool // only validate the configuration and exit
+}
+
+// RegisterFlags defines the flags shared by the gateway binaries.
+// The flag defaults are read from the environment.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.ConfigFile, "config", envOr("GATEWAY_CONFIG", DefaultConfigFile), "path of the gateway configuration file (env GATEWAY_CONFIG)")
+	fs.StringVar(&o.DBFile, "db", os.Getenv("GATEWAY_DB_FILE"), "path of the sqlite database, overrides db_file (env GATEWAY_DB_FILE)")
+	fs.BoolVar(&o.Validate, "validate", false, "validate the configuration and exit")
+}
+
+// RegisterServerFlags defines the flags of the gateway server, in addition to the shared ones.
+func (o *Options) RegisterServerFlags(fs *flag.FlagSet) {
+	o.RegisterFlags(fs)
+	fs.StringVar(&o.Address, "addr", os.Getenv("GATEWAY_ADDRESS"), "listen address, overrides the gateway address (env GATEWAY_ADDRESS)")
+	fs.StringVar(&o.LogLevel, "log-level", os.Getenv("GATEWAY_LOG_LEVEL"), "debug, info or error, overrides log_level (env GATEWAY_LOG_LEVEL)")
+}
+
+// Load reads and validates the configuration file, then applies the options.
+// The gateway and the migration use it, so they always agree on the database file.
+func (o *Options) Load() (*Config, error) {
+	rawconf, err := Load(o.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if rawconf.Gateway != nil {
+		if o.DBFile != "" {
+			// relative to the working directory, unlike db_file
+			dbFile, err := filepath.Abs(o.DBFile)
+			if err != nil {
+				return nil, err
+			}
+			rawconf.Gateway.DBFile = dbFile
+		}
+		if o.LogLevel != "" {
+			rawconf.Gateway.LogLevel = o.LogLevel
+		}
+	}
+
+	conf, err := rawconf.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// applied after parsing, so it takes precedence over PORT
+	if o.Address != "" {
+		if conf.Admin != nil && conf.Admin.Address == o.Address {
+			return nil, ErrInvalidAdminAddress
+		}
+		conf.Address = o.Address
+	}
+
+	return conf, nil
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// sqlIdentifier matches the table names accepted for fixed window routes.
+// Table names are concatenated into SQL queries, so they must be plain identifiers.
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Backends keeping the limiting state of a route.
+const (
+	BackendMemory  = "memory"  // per gateway, token_bucket only
+	BackendSQL     = "sql"     // the storage database, fixed_window only
+	BackendRedis   = "redis"   // shared by the gateways, any strategy
+	BackendCluster = "cluster" // per gateway, synchronized with the cluster peers
+	BackendRing    = "ring"    // kept by the cluster member owning the user
+)
+
+// Policies of a route when its backend fails to decide on a request.
+const (
+	OnErrorDeny  = "deny"  // the request is rejected with 503
+	OnErrorAllow = "allow" // the request is sent to the API
+)
+
+// RouteConfig holds the rate limiting settings of a route.
+type RouteConfig struct {
+	Strategy     string `json:"strategy"`
+	Backend      string `json:"backend"`
+	BucketCap    int    `json:"capacity,omitempty"`    // for token bucket
+	WindowLength int    `json:"window_size,omitempty"` // for fixed and sliding window, seconds
+	SqlTable     string `json:"sql_table,omitempty"`   // for fixed window on the sql backend
+	OnError      string `json:"on_error,omitempty"`    // deny if empty
+}
+
+// parseRoutes validates the routes blocks, nil if there is none.
+func (rawconf *hclConf) parseRoutes() (map[string]RouteConfig, error) {
+	routes, diags := rawconf.checkRoutes()
+	if err := DiagnosticsError(diags); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// checkRoutes validates the routes blocks and reports every problem found.
+// The routes need the redis and cluster blocks of their backends.
+func (rawconf *hclConf) checkRoutes() (map[string]RouteConfig, hcl.Diagnostics) {
+	if len(rawconf.Routes) == 0 {
+		return nil, nil
+	}
+
+	diags := hcl.Diagnostics{}
+	routes := map[string]RouteConfig{}
+	seen := map[string]*hclsyntax.Block{}
+
+	for _, route := range rawconf.Routes {
+		if first, found := seen[route.Path]; found {
+			detail := fmt.Sprintf("The route %s is defined twice.", route.Path)
+			if first != nil {
+				detail = fmt.Sprintf("The route %s is already defined at %s.", route.Path, first.Body.Attributes["path"].SrcRange)
+			}
+			diags = append(diags, routeError(route.block, "path", fmt.Errorf("%w %s", ErrDuplicateRoute, route.Path), "Duplicate route path", detail))
+			continue
+		}
+		seen[route.Path] = route.block
+
+		if route.Limit != 0 {
+			diags = append(diags, routeWarning(route.block, "limit", "The limit attribute is not used by any strategy."))
+		}
+
+		routeConf := RouteConfig{
+			Strategy:     route.Strategy,
+			Backend:      route.Backend,
+			BucketCap:    route.Capacity,
+			WindowLength: route.WindowSize,
+			SqlTable:     route.SqlTable,
+			OnError:      route.OnError,
+		}
+		routeDiags := routeConf.validate(route.Path, route.block)
+
+		switch {
+		case routeConf.Backend == BackendRedis && rawconf.Redis == nil:
+			routeDiags = append(routeDiags, routeError(route.block, "backend", fmt.Errorf("%w %s", ErrMissingRedis, route.Path),
+				"Missing redis block", fmt.Sprintf("The %s backend needs a redis block.", routeConf.Backend)))
+		case (routeConf.Backend == BackendCluster || routeConf.Backend == BackendRing) && rawconf.Cluster == nil:
+			routeDiags = append(routeDiags, routeError(route.block, "backend", fmt.Errorf("%w %s", ErrMissingCluster, route.Path),
+				"Missing cluster block", fmt.Sprintf("The %s backend needs a cluster block.", routeConf.Backend)))
+		}
+
+		diags = append(diags, routeDiags...)
+		if !routeDiags.HasErrors() {
+			routes[route.Path] = routeConf
+		}
+	}
+
+	return routes, diags
+}
+
+// Validate checks the settings of the route with the given path and fills in the defaults.
+// Settings that don't apply to the route strategy are cleared, with a warning.
+// The error diagnostics carry an error wrapping one of the Err variables, see DiagnosticsError.
+func (route *RouteConfig) Validate(path string) hcl.Diagnostics {
+	return route.validate(path, nil)
+}
+
+// validate is Validate for a route read from a routes block, which positions the diagnostics.
+// The block is nil for the routes set through the admin API.
+func (route *RouteConfig) validate(path string, block *hclsyntax.Block) hcl.Diagnostics {
+	diags := hcl.Diagnostics{}
+
+	if !strings.HasPrefix(path, "/") {
+		diags = append(diags, routeError(block, "path", fmt.Errorf("%w %s", ErrRoutePath, path),
+			"Invalid route path", fmt.Sprintf("The route path %q must start with /.", path)))
+	}
+
+	switch route.OnError {
+	case "":
+		route.OnError = OnErrorDeny
+	case OnErrorDeny, OnErrorAllow:
+	default:
+		diags = append(diags, routeError(block, "on_error", fmt.Errorf("%w %s", ErrInvalidOnError, path),
+			"Invalid on_error", fmt.Sprintf("The on_error policy %q is not supported. Use deny or allow.", route.OnError)))
+	}
+
+	switch route.Strategy {
+	case "token_bucket":
+		if route.BucketCap <= 0 {
+			diags = append(diags, routeError(block, "capacity", fmt.Errorf("%w %s", ErrTokenCapacity, path),
+				"Invalid capacity", "token_bucket routes must set a capacity > 0."))
+		}
+		diags = append(diags, route.validateBackend(path, block, BackendMemory, BackendRedis, BackendCluster, BackendRing)...)
+		diags = append(diags, clearUnused(block, &route.WindowLength, "window_size", route.Strategy)...)
+		diags = append(diags, clearUnused(block, &route.SqlTable, "sql_table", route.Strategy)...)
+
+	case "fixed_window":
+		diags = append(diags, route.validateWindowSize(path, block)...)
+		diags = append(diags, route.validateBackend(path, block, BackendSQL, BackendRedis, BackendCluster, BackendRing)...)
+		if route.Backend != BackendSQL && route.SqlTable != "" {
+			route.SqlTable = ""
+			diags = append(diags, routeWarning(block, "sql_table", "The sql_table attribute is only used by the sql backend."))
+		} else if route.Backend == BackendSQL && route.SqlTable == "" {
+			route.SqlTable = "request_count"
+		}
+		if route.SqlTable != "" && !sqlIdentifier.MatchString(route.SqlTable) {
+			diags = append(diags, routeError(block, "sql_table", fmt.Errorf("%w %s", ErrSqlTable, path),
+				"Invalid sql_table", fmt.Sprintf("%q is not a valid SQL table name. Use letters, digits and underscores only.", route.SqlTable)))
+		}
+		diags = append(diags, clearUnused(block, &route.BucketCap, "capacity", route.Strategy)...)
+
+	case "sliding_window":
+		diags = append(diags, route.validateWindowSize(path, block)...)
+		diags = append(diags, route.validateBackend(path, block, BackendRedis)...)
+		diags = append(diags, clearUnused(block, &route.BucketCap, "capacity", route.Strategy)...)
+		diags = append(diags, clearUnused(block, &route.SqlTable, "sql_table", route.Strategy)...)
+
+	default:
+		diags = append(diags, routeError(block, "strategy", fmt.Errorf("%w %s", ErrInvalidStrategy, path),
+			"Unknown strategy", fmt.Sprintf("The strategy %q is not supported. Use token_bucket, fixed_window or sliding_window.", route.Strategy)))
+	}
+
+	return diags
+}
+
+// validateWindowSize checks the window size of the fixed and sliding window routes.
+func (route *RouteConfig) validateWindowSize(path string, block *hclsyntax.Block) hcl.Diagnostics {
+	if route.WindowLength > 0 {
+		return nil
+	}
+	return hcl.Diagnostics{routeError(block, "window_size", fmt.Errorf("%w %s", ErrWindowSize, path),
+		"Invalid window_size", route.Strategy+" routes must set a window_size > 0.")}
+}
+
+// validateBackend checks that the route backend is one of the given ones.
+// An empty backend is set to the first one.
+func (route *RouteConfig) validateBackend(path string, block *hclsyntax.Block, backends ...string) hcl.Diagnostics {
+	if route.Backend == "" {
+		route.Backend = backends[0]
+	}
+	if !slices.Contains(backends, route.Backend) {
+		return hcl.Diagnostics{routeError(block, "backend",
+			fmt.Errorf("%w %s: %s must use %s", ErrInvalidBackend, path, route.Strategy, strings.Join(backends, " or ")),
+			"Invalid backend", fmt.Sprintf("The backend %q is not supported by %s routes. Use %s.", route.Backend, route.Strategy, strings.Join(backends, " or ")))}
+	}
+	return nil
+}
+
+// clearUnused resets a setting that the route strategy doesn't use, warning if it was set.
+func clearUnused[T comparable](block *hclsyntax.Block, setting *T, name, strategy string) hcl.Diagnostics {
+	var zero T
+	if *setting == zero {
+		return nil
+	}
+	*setting = zero
+	return hcl.Diagnostics{routeWarning(block, name, fmt.Sprintf("The %s attribute is not used by %s routes.", name, strategy))}
+}
+
+// routeError returns an error diagnostic about an attribute of a route, carrying err.
+// It is positioned at the attribute, or at the block if the attribute is not set.
+func routeError(block *hclsyntax.Block, name string, err error, summary, detail string) *hcl.Diagnostic {
+	diag := &hcl.Diagnostic{Severity: hcl.DiagError, Summary: summary, Detail: detail}
+	if block != nil {
+		if attr, found := block.Body.Attributes[name]; found {
+			diag = attrError(attr, summary, detail)
+		} else {
+			diag = blockError(block, summary, detail)
+		}
+	}
+	diag.Extra = err
+	return diag
+}
+
+// routeWarning returns an unused attribute warning about an attribute of a route.
+func routeWarning(block *hclsyntax.Block, name, detail string) *hcl.Diagnostic {
+	if block != nil {
+		if attr, found := block.Body.Attributes[name]; found {
+			return attrWarning(attr, "Unused attribute", detail)
+		}
+	}
+	return &hcl.Diagnostic{Severity: hcl.DiagWarning, Summary: "Unused attribute", Detail: detail}
+}
+
+// DiagnosticsError returns the error carried by the first error diagnostic, nil if there is none.
+// The errors of Validate wrap one of the Err variables.
+func DiagnosticsError(diags hcl.Diagnostics) error {
+	for _, diag := range diags {
+		if diag.Severity != hcl.DiagError {
+			continue
+		}
+		if err, ok := diag.Extra.(error); ok {
+			return err
+		}
+		return diag
+	}
+	return nil
+}
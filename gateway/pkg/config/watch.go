@@ -0,0 +1,35 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls a file every interval and calls onChange when its modification time or size changes.
+// It returns when the context is done.
+func Watch(ctx context.Context, filename string, interval time.Duration, onChange func()) {
+	last, _ := os.Stat(filename)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			// the file may be replaced by an editor, try again later
+			continue
+		}
+
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			onChange()
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package errorlog
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
+)
+
+// Level is the minimum severity of the messages written to the log file.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
 )
 
 type Logger struct {
-	file *os.File
+	file  *os.File
+	level atomic.Int32
+	info  *log.Logger
+	debug *log.Logger
 	*log.Logger
 }
 
@@ -16,11 +30,47 @@ func New(logFile string) (*Logger, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Logger{
-		file,
-		log.New(file, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
-	}, nil
+	flags := log.Ldate | log.Ltime | log.Lshortfile
+
+	logger := &Logger{
+		file:   file,
+		info:   log.New(file, "INFO: ", flags),
+		debug:  log.New(file, "DEBUG: ", flags),
+		Logger: log.New(file, "ERROR: ", flags),
+	}
+	logger.SetLevel(LevelInfo)
+
+	return logger, nil
+
+}
+
+// ParseLevel converts a level name (debug, info or error) to a Level.
+// An empty name is the info level.
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info or error", name)
+}
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
 
+// SetLevel changes the minimum level of the messages written to the log file.
+func (l *Logger) SetLevel(level Level) {
+	l.level.Store(int32(level))
 }
 
 // WriteError writes an error message to the log file.
@@ -30,11 +80,19 @@ func (l *Logger) WriteError(err error) {
 }
 
 // WriteInfo writes an informational message to the log file.
-// The prefix is temporarily changed to "INFO: " for this message.
 func (l *Logger) WriteInfo(info string) {
-	l.SetPrefix("INFO: ")
-	l.Println(info)
-	l.SetPrefix("ERROR: ")
+	if Level(l.level.Load()) > LevelInfo {
+		return
+	}
+	l.info.Println(info)
+}
+
+// WriteDebug writes a debug message to the log file.
+func (l *Logger) WriteDebug(msg string) {
+	if Level(l.level.Load()) > LevelDebug {
+		return
+	}
+	l.debug.Println(msg)
 }
 
 // Close closes the log file.
@@ -0,0 +1,363 @@
+package limiter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// newAdminMux returns the handler of the admin listener.
+// It serves the management, metrics and debug endpoints.
+// Every endpoint except /healthz requires the admin key as a bearer token.
+func (l *Limiter) newAdminMux() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/users", l.handleListUsers)
+	mux.HandleFunc("POST /admin/users", l.handleCreateUser)
+	mux.HandleFunc("GET /admin/users/{id}", l.handleGetUser)
+	mux.HandleFunc("PATCH /admin/users/{id}", l.handleUpdateUser)
+	mux.HandleFunc("DELETE /admin/users/{id}", l.handleDeleteUser)
+	mux.HandleFunc("POST /admin/users/{id}/suspend", l.handleSuspendUser(true))
+	mux.HandleFunc("POST /admin/users/{id}/unsuspend", l.handleSuspendUser(false))
+
+	mux.HandleFunc("GET /admin/users/{id}/limits", l.handleGetLimits)
+	mux.HandleFunc("POST /admin/users/{id}/limits/reset", l.handleResetLimits)
+	mux.HandleFunc("POST /admin/users/{id}/limits/topup", l.handleTopUpLimits)
+
+	mux.HandleFunc("GET /admin/routes", l.handleListRoutes)
+	mux.HandleFunc("POST /admin/routes", l.handleCreateRoute)
+	mux.HandleFunc("GET /admin/routes/{path...}", l.handleGetRoute)
+	mux.HandleFunc("PUT /admin/routes/{path...}", l.handleUpdateRoute)
+	mux.HandleFunc("DELETE /admin/routes/{path...}", l.handleDeleteRoute)
+
+	mux.HandleFunc("GET /admin/config", l.handleGetConfig)
+	mux.HandleFunc("GET /admin/cluster", l.handleGetCluster)
+
+	// kept for existing clients
+	mux.HandleFunc("PUT /users/{id}", l.handleUpdateQuota)
+
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, errNotFound.Error())
+	})
+
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	root.Handle("/", l.requireAdminKey(mux))
+
+	return root
+}
+
+// requireAdminKey rejects requests that don't carry the admin key as a bearer token.
+// Failed attempts count towards the client lockout, like on the public listener.
+func (l *Limiter) requireAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.authGuard.clientIP(r)
+		if lockedFor := l.authGuard.lockedFor(ip); lockedFor > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(lockedFor.Seconds())+1))
+			writeJSONError(w, http.StatusTooManyRequests, errAuthLockout.Error())
+			return
+		}
+
+		l.settingsMu.RLock()
+		adminKey := l.adminKey
+		l.settingsMu.RUnlock()
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminKey.Reveal())) != 1 {
+			l.logger.WriteError(fmt.Errorf("admin: %w", errUnauthorized))
+			metrics.Add(metricAuthFailures, 1)
+			if lockout := l.authGuard.fail(ip); lockout > 0 {
+				metrics.Add(metricAuthLockouts, 1)
+				l.logger.WriteError(fmt.Errorf("admin: %w: client %s locked out for %s", errAuthLockout, ip, lockout))
+			}
+			writeJSONError(w, http.StatusUnauthorized, errUnauthorized.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := storage.UserFilter{
+		Name:  query.Get("name"),
+		Limit: defaultPageSize,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxPageSize {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		filter.Limit = n
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be >= 0")
+			return
+		}
+		filter.Offset = n
+	}
+
+	if suspended := query.Get("suspended"); suspended != "" {
+		b, err := strconv.ParseBool(suspended)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "suspended must be a boolean")
+			return
+		}
+		filter.Suspended = &b
+	}
+
+	users, total, err := l.listUsers(r.Context(), filter)
+	if err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"users":  users,
+		"total":  total,
+		"limit":  filter.Limit,
+		"offset": filter.Offset,
+	})
+}
+
+func (l *Limiter) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	u, err := l.getUser(r.Context(), userId)
+	if err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (l *Limiter) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Id        int64   `json:"id"`
+		Name      string  `json:"name"`
+		Rate      float64 `json:"rate"`
+		Suspended bool    `json:"suspended"`
+	}{}
+
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	u := &storage.User{
+		Id:        data.Id,
+		Name:      data.Name,
+		Rate:      data.Rate,
+		Suspended: data.Suspended,
+	}
+
+	if err := l.createUser(r.Context(), u); err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, u)
+}
+
+func (l *Limiter) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	data := struct {
+		Name *string  `json:"name"`
+		Rate *float64 `json:"rate"`
+	}{}
+
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	u, err := l.updateUser(r.Context(), userId, data.Name, data.Rate)
+	if err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (l *Limiter) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	if err := l.deleteUser(r.Context(), userId); err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (l *Limiter) handleSuspendUser(suspended bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := pathUserId(w, r)
+		if !ok {
+			return
+		}
+
+		u, err := l.setUserSuspended(r.Context(), userId, suspended)
+		if err != nil {
+			l.writeAdminError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, u)
+	}
+}
+
+func (l *Limiter) handleUpdateQuota(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	data := struct {
+		Rate float64 `json:"rate"`
+	}{}
+
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	if err := l.updateUserQuota(userId, data.Rate); err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"userId": userId,
+		"rate":   data.Rate,
+	})
+}
+
+// handleGetConfig responds with the effective configuration, as JSON or HCL, with secrets redacted.
+func (l *Limiter) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := l.config.Load()
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		data, err := cfg.DumpJSON()
+		if err != nil {
+			l.writeAdminError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case "hcl":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(cfg.DumpHCL())
+
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or hcl")
+	}
+}
+
+// handleGetCluster responds with the id of this gateway in the cluster, the ring and the status of its peers.
+func (l *Limiter) handleGetCluster(w http.ResponseWriter, r *http.Request) {
+	if l.cluster == nil {
+		writeJSONError(w, http.StatusNotFound, errClusterNotConfigured.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, l.cluster.Status())
+}
+
+// writeAdminError maps an error to a JSON response with a matching status code.
+// Unexpected errors are logged and hidden from the client.
+func (l *Limiter) writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound), errors.Is(err, errRouteNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errUserExists), errors.Is(err, errRouteExists), errors.Is(err, errNotOwner):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errPeerFailed):
+		l.logger.WriteError(fmt.Errorf("admin request failed: %w", err))
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+	case errors.Is(err, errInvalidRate), errors.Is(err, errInvalidName), errors.Is(err, errUnknownTable),
+		errors.Is(err, errRedisNotConfigured), errors.Is(err, errClusterNotConfigured), errors.Is(err, config.ErrInvalidBackend),
+		errors.Is(err, config.ErrRoutePath), errors.Is(err, config.ErrInvalidStrategy),
+		errors.Is(err, config.ErrTokenCapacity), errors.Is(err, config.ErrWindowSize), errors.Is(err, config.ErrSqlTable),
+		errors.Is(err, config.ErrInvalidOnError):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		l.logger.WriteError(fmt.Errorf("admin request failed: %w", err))
+		writeJSONError(w, http.StatusInternalServerError, "internal server error")
+	}
+}
+
+// pathUserId returns the {id} path value, responding with 400 if it is not an integer.
+func pathUserId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userId := r.PathValue("id")
+	if _, err := strconv.ParseInt(userId, 10, 64); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errInvalidId.Error())
+		return "", false
+	}
+	return userId, true
+}
+
+// decodeJSON decodes the request body into v, responding with 400 on failure.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
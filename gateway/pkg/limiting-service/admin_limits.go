@@ -0,0 +1,123 @@
+package limiter
+
+import (
+	"gateway/pkg/strategy"
+	"net/http"
+	"sort"
+)
+
+// handleGetLimits returns the limiting state of a user, for one route or all routes.
+func (l *Limiter) handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	userId, inspectors, ok := l.limitsRequest(w, r, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+
+	l.writeLimits(w, userId, inspectors)
+}
+
+// handleResetLimits clears the limiting state of a user, for one route or all routes.
+func (l *Limiter) handleResetLimits(w http.ResponseWriter, r *http.Request) {
+	userId, inspectors, ok := l.limitsRequest(w, r, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+
+	for path, inspector := range inspectors {
+		if err := inspector.Reset(userId, path); err != nil {
+			l.writeAdminError(w, err)
+			return
+		}
+	}
+
+	l.writeLimits(w, userId, inspectors)
+}
+
+// handleTopUpLimits grants a user additional requests, for one route or all routes.
+func (l *Limiter) handleTopUpLimits(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Path   string `json:"path"`
+		Amount int    `json:"amount"`
+	}{}
+
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	if data.Amount <= 0 {
+		writeJSONError(w, http.StatusBadRequest, errInvalidAmount.Error())
+		return
+	}
+
+	userId, inspectors, ok := l.limitsRequest(w, r, data.Path)
+	if !ok {
+		return
+	}
+
+	for path, inspector := range inspectors {
+		if err := inspector.TopUp(userId, path, data.Amount); err != nil {
+			l.writeAdminError(w, err)
+			return
+		}
+	}
+
+	l.writeLimits(w, userId, inspectors)
+}
+
+// writeLimits responds with the limiting state of a user for the given routes, sorted by path.
+func (l *Limiter) writeLimits(w http.ResponseWriter, userId string, inspectors map[string]strategy.Inspector) {
+	states := []strategy.State{}
+	for _, path := range sortedPaths(inspectors) {
+		state, err := inspectors[path].State(userId, path)
+		if err != nil {
+			l.writeAdminError(w, err)
+			return
+		}
+		states = append(states, state)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"userId": userId,
+		"limits": states,
+	})
+}
+
+// limitsRequest validates the user of a limits request and returns the inspectors of the requested routes.
+// An empty path selects all routes. It responds with an error if the user or the route doesn't exist.
+func (l *Limiter) limitsRequest(w http.ResponseWriter, r *http.Request, path string) (string, map[string]strategy.Inspector, bool) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return "", nil, false
+	}
+
+	if _, err := l.getUser(r.Context(), userId); err != nil {
+		l.writeAdminError(w, err)
+		return "", nil, false
+	}
+
+	inspectors := map[string]strategy.Inspector{}
+	for _, route := range l.listRoutes() {
+		if path != "" && path != route.Path {
+			continue
+		}
+		if inspector, ok := route.limit.(strategy.Inspector); ok {
+			inspectors[route.Path] = inspector
+		}
+	}
+
+	if path != "" && len(inspectors) == 0 {
+		writeJSONError(w, http.StatusNotFound, errRouteNotFound.Error())
+		return "", nil, false
+	}
+
+	return userId, inspectors, true
+}
+
+func sortedPaths(inspectors map[string]strategy.Inspector) []string {
+	paths := make([]string, 0, len(inspectors))
+	for path := range inspectors {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
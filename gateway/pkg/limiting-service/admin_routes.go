@@ -0,0 +1,90 @@
+package limiter
+
+import (
+	"gateway/pkg/config"
+	"net/http"
+)
+
+// routeRequest is the body of the route create and update requests.
+type routeRequest struct {
+	Path       string `json:"path"`
+	Strategy   string `json:"strategy"`
+	Backend    string `json:"backend"`
+	Capacity   int    `json:"capacity"`
+	WindowSize int    `json:"window_size"`
+	SqlTable   string `json:"sql_table"`
+	OnError    string `json:"on_error"`
+}
+
+func (req routeRequest) config() config.RouteConfig {
+	return config.RouteConfig{
+		Strategy:     req.Strategy,
+		Backend:      req.Backend,
+		BucketCap:    req.Capacity,
+		WindowLength: req.WindowSize,
+		SqlTable:     req.SqlTable,
+		OnError:      req.OnError,
+	}
+}
+
+func (l *Limiter) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"routes": l.listRoutes(),
+	})
+}
+
+func (l *Limiter) handleGetRoute(w http.ResponseWriter, r *http.Request) {
+	route := l.lookupRoute("/" + r.PathValue("path"))
+	if route == nil {
+		writeJSONError(w, http.StatusNotFound, errRouteNotFound.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (l *Limiter) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
+	var data routeRequest
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	route, err := l.saveRoute(r.Context(), data.Path, data.config(), true)
+	if err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, route)
+}
+
+// handleUpdateRoute creates or replaces the route at the request path.
+func (l *Limiter) handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
+	var data routeRequest
+	if !decodeJSON(w, r, &data) {
+		return
+	}
+
+	path := "/" + r.PathValue("path")
+	if data.Path != "" && data.Path != path {
+		writeJSONError(w, http.StatusBadRequest, "path does not match the request path")
+		return
+	}
+
+	route, err := l.saveRoute(r.Context(), path, data.config(), false)
+	if err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (l *Limiter) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
+	if err := l.deleteRoute(r.Context(), "/"+r.PathValue("path")); err != nil {
+		l.writeAdminError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,166 @@
+package limiter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the number of client IPs kept by the auth guard
+// before stale entries are swept.
+const maxTrackedClients = 10000
+
+// authGuard counts failed authentication attempts per client IP.
+// A client reaching maxFailures within the lockout period is locked out
+// until the period ends. Successful attempts don't clear the failures: they only age out
+// once the lockout period since the first failure ends, so a valid key doesn't allow guessing others.
+// Behind trusted proxies, clients are identified by the X-Forwarded-For header, see clientIP.
+type authGuard struct {
+	mu             sync.Mutex
+	maxFailures    int
+	lockout        time.Duration
+	trustedProxies []netip.Prefix
+	clients        map[string]*authAttempts
+}
+
+type authAttempts struct {
+	failures     int
+	firstFailure time.Time
+	lockedUntil  time.Time
+}
+
+func newAuthGuard(maxFailures int, lockout time.Duration, trustedProxies []netip.Prefix) *authGuard {
+	return &authGuard{
+		maxFailures:    maxFailures,
+		lockout:        lockout,
+		trustedProxies: trustedProxies,
+		clients:        map[string]*authAttempts{},
+	}
+}
+
+// configure changes the lockout settings and the trusted proxies. Current lockouts are kept.
+func (g *authGuard) configure(maxFailures int, lockout time.Duration, trustedProxies []netip.Prefix) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.maxFailures = maxFailures
+	g.lockout = lockout
+	g.trustedProxies = trustedProxies
+}
+
+// lockedFor returns the remaining lockout time for a client, or 0 if the client is not locked out.
+func (g *authGuard) lockedFor(ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	attempts, found := g.clients[ip]
+	if !found {
+		return 0
+	}
+
+	remaining := time.Until(attempts.lockedUntil)
+	if remaining <= 0 {
+		return 0
+	}
+	return remaining
+}
+
+// fail records a failed attempt for a client.
+// If this failure triggers a lockout, it returns the lockout duration. Otherwise, it returns 0.
+func (g *authGuard) fail(ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+
+	attempts, found := g.clients[ip]
+	if !found || now.Sub(attempts.firstFailure) > g.lockout {
+		if len(g.clients) >= maxTrackedClients {
+			g.sweep(now)
+		}
+		attempts = &authAttempts{firstFailure: now}
+		g.clients[ip] = attempts
+	}
+
+	attempts.failures++
+	if attempts.failures < g.maxFailures {
+		return 0
+	}
+
+	attempts.lockedUntil = now.Add(g.lockout)
+	attempts.failures = 0
+	attempts.firstFailure = now
+	return g.lockout
+}
+
+// sweep removes clients that are neither locked out nor within a failure period.
+// The caller must hold the lock.
+func (g *authGuard) sweep(now time.Time) {
+	for ip, attempts := range g.clients {
+		if now.After(attempts.lockedUntil) && now.Sub(attempts.firstFailure) > g.lockout {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// clientIP returns the IP address of the client that sent the request.
+// Requests from a trusted proxy are identified by X-Forwarded-For instead. Each proxy appends the address
+// it received the request from, so the client is the last address that isn't a trusted proxy.
+// Addresses before it are set by the client and ignored.
+func (g *authGuard) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+
+	g.mu.Lock()
+	trusted := g.trustedProxies
+	g.mu.Unlock()
+
+	if !isTrustedProxy(trusted, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// not appended by a proxy, keep the last known hop
+			return ip
+		}
+		ip = addr.Unmap().String()
+		if !isTrustedProxy(trusted, ip) {
+			return ip
+		}
+	}
+
+	// every hop is a trusted proxy
+	return ip
+}
+
+// remoteIP returns the IP address of the peer that sent the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isTrustedProxy(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,33 +2,94 @@ package limiter
 
 import (
 	"context"
-	"database/sql"
-
-	_ "modernc.org/sqlite"
+	"gateway/pkg/storage"
+	"strconv"
 )
 
-// NewDB initializes and returns a new database connection.
-func NewDB(ctx context.Context, filename string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", "file:"+filename)
-	if err != nil {
-		return nil, err
+func (l *Limiter) updateUserQuota(userId string, requestRate float64) error {
+	if requestRate <= 0 {
+		return errInvalidRate
+	}
+
+	if err := l.store.UpdateUser(context.Background(), userId, nil, &requestRate); err != nil {
+		return err
+	}
+
+	l.userIdCache.Add(userId, requestRate)
+	return nil
+}
+
+func (l *Limiter) listUsers(ctx context.Context, filter storage.UserFilter) ([]storage.User, int, error) {
+	return l.store.ListUsers(ctx, filter)
+}
+
+func (l *Limiter) getUser(ctx context.Context, userId string) (*storage.User, error) {
+	return l.store.GetUser(ctx, userId)
+}
+
+// createUser inserts a new user. If the id is 0, the database assigns one.
+func (l *Limiter) createUser(ctx context.Context, u *storage.User) error {
+	if u.Rate <= 0 {
+		return errInvalidRate
+	}
+	if u.Name == "" {
+		return errInvalidName
+	}
+
+	if err := l.store.CreateUser(ctx, u); err != nil {
+		return err
 	}
 
-	if err := db.PingContext(ctx); err != nil {
+	l.userIdCache.Remove(strconv.FormatInt(u.Id, 10))
+	return nil
+}
+
+// updateUser changes the name and/or the rate of a user. Nil fields are left unchanged.
+func (l *Limiter) updateUser(ctx context.Context, userId string, name *string, rate *float64) (*storage.User, error) {
+	if rate != nil && *rate <= 0 {
+		return nil, errInvalidRate
+	}
+	if name != nil && *name == "" {
+		return nil, errInvalidName
+	}
+
+	if err := l.store.UpdateUser(ctx, userId, name, rate); err != nil {
 		return nil, err
 	}
-	return db, nil
+
+	l.userIdCache.Remove(userId)
+	return l.getUser(ctx, userId)
 }
 
-func (l *Limiter) updateUserQuota(userId string, requestRate float64) error {
-	_, err := l.sqlDb.Exec(`
-	UPDATE users SET quota = ? WHERE id = ?`,
-		requestRate, userId,
-	)
+func (l *Limiter) deleteUser(ctx context.Context, userId string) error {
+	if err := l.store.DeleteUser(ctx, userId); err != nil {
+		return err
+	}
 
-	if err == nil {
-		l.userIdCache.Add(userId, requestRate)
+	l.userIdCache.Remove(userId)
+	return nil
+}
+
+// setUserSuspended suspends or unsuspends a user.
+// Suspended users are rejected by the gateway as if they didn't exist.
+func (l *Limiter) setUserSuspended(ctx context.Context, userId string, suspended bool) (*storage.User, error) {
+	if err := l.store.SetUserSuspended(ctx, userId, suspended); err != nil {
+		return nil, err
 	}
 
-	return err
+	l.userIdCache.Remove(userId)
+	return l.getUser(ctx, userId)
+}
+
+// checkTable returns errUnknownTable if the fixed window table doesn't exist.
+// The table name must already be validated.
+func (l *Limiter) checkTable(ctx context.Context, table string) error {
+	exists, err := l.store.TableExists(ctx, table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownTable
+	}
+	return nil
 }
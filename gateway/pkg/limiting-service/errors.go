@@ -1,9 +1,32 @@
 package limiter
 
-import "fmt"
+import (
+	"fmt"
+	"gateway/pkg/cluster"
+	"gateway/pkg/storage"
+)
 
 var (
 	errUnauthorized      = fmt.Errorf("unauthorized")
 	errNotFound          = fmt.Errorf("not found")
 	errRateLimitExceeded = fmt.Errorf("rate limit exceeded")
+	errAuthLockout       = fmt.Errorf("too many failed authentication attempts")
+	errLimiterFailed     = fmt.Errorf("rate limiter failed")
+	errUserLookupFailed  = fmt.Errorf("user lookup failed")
+
+	errUserNotFound = storage.ErrUserNotFound
+	errUserExists   = storage.ErrUserExists
+	errInvalidRate  = fmt.Errorf("rate must be > 0")
+	errInvalidName  = fmt.Errorf("name must not be empty")
+	errInvalidId    = fmt.Errorf("user id must be an integer")
+
+	errRouteNotFound = fmt.Errorf("route not found")
+	errInvalidAmount = fmt.Errorf("amount must be > 0")
+	errRouteExists   = fmt.Errorf("route already exists")
+	errUnknownTable  = fmt.Errorf("sql_table does not exist")
+
+	errRedisNotConfigured   = fmt.Errorf("the redis backend is not configured, add a redis block and restart the gateway")
+	errClusterNotConfigured = fmt.Errorf("the cluster backend is not configured, add a cluster block and restart the gateway")
+	errNotOwner             = cluster.ErrNotOwner
+	errPeerFailed           = cluster.ErrPeerFailed
 )
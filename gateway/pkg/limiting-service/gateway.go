@@ -2,31 +2,60 @@ package limiter
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
+	"expvar"
 	"fmt"
+	"gateway/pkg/cluster"
 	"gateway/pkg/config"
 	errorlog "gateway/pkg/error-log"
-	"gateway/pkg/strategy"
+	"gateway/pkg/migrations"
+	"gateway/pkg/storage"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 )
 
 // Limiter represents a rate limiter structure.
 type Limiter struct {
 	address string
+	logFile string
+
+	storage     string // sqlite or postgres
+	dbFile      string
+	databaseURL config.Secret
 
 	logger      *errorlog.Logger
-	routeLimits map[string]strategy.LimitStrategy
-	sqlDb       *sql.DB
+	store       *storage.Store
+	redis       *redis.Client // nil if the redis backend is not configured
+	cluster     *cluster.Node // nil if the cluster backend is not configured
 	userIdCache *UserCache
+	userLookups singleflight.Group                                        // coalesces the database lookups of the same user
+	userQuota   func(ctx context.Context, userId string) (float64, error) // l.store.UserQuota, replaced by tests
+
+	lastUserChange int64 // id of the last user change at startup, see watchUserChanges
+	authGuard      *authGuard
 
+	reloadMu   sync.Mutex   // serializes config reloads
+	settingsMu sync.RWMutex // guards the settings that can be reloaded
 	apiAddress string
-	apiKey     string
+	apiKey     config.Secret
+
+	adminAddress string // empty if the admin listener is disabled
+	adminKey     config.Secret
+
+	clusterAddress string // empty if the cluster listener is disabled
+
+	config       atomic.Pointer[config.Config] // the effective configuration, for introspection
+	configRoutes map[string]config.RouteConfig
+	routes       atomic.Pointer[routeTable]
+	routesMu     sync.Mutex // serializes route changes
 }
 
 // New creates a new Limiter instance with the provided configuration.
@@ -35,53 +64,91 @@ func New(ctx context.Context, cfg *config.Config) (*Limiter, error) {
 	if err != nil {
 		return nil, err
 	}
+	logger.SetLevel(cfg.LogLevel)
 
-	db, err := NewDB(ctx, cfg.DBFile)
+	store, err := storage.Open(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	migrator, err := migrations.New(store)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrator.Check(ctx); err != nil {
+		return nil, err
+	}
+
+	lastUserChange, err := store.LastUserChange(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the user changes: %w", err)
+	}
+
+	var redisClient *redis.Client
+	if cfg.Redis != nil {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Address,
+			Password: cfg.Redis.Password.Reveal(),
+			DB:       cfg.Redis.DB,
+		})
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			redisClient.Close()
+			return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		}
+	}
+
 	lim := &Limiter{
 		address: cfg.Address,
-
-		sqlDb:  db,
-		logger: logger,
-		userIdCache: &UserCache{
-			data: make(map[string]userData),
-			ttl:  cfg.UserCacheTTL * time.Minute,
-		},
-		apiAddress: cfg.Api.Address,
-		apiKey:     cfg.Api.Key,
+		logFile: cfg.LogFile,
+
+		storage:     cfg.Storage,
+		dbFile:      cfg.DBFile,
+		databaseURL: cfg.DatabaseURL,
+
+		store:          store,
+		userQuota:      store.UserQuota,
+		lastUserChange: lastUserChange,
+		redis:          redisClient,
+		logger:         logger,
+		userIdCache:    newUserCache(cfg.UserCacheSize, cfg.NegativeCacheSize, cfg.UserCacheTTL*time.Minute, cfg.NegativeCacheTTL),
+		authGuard:      newAuthGuard(cfg.AuthMaxFailures, cfg.AuthLockout, cfg.TrustedProxies),
+		apiAddress:     cfg.Api.Address,
+		apiKey:         cfg.Api.Key,
+
+		configRoutes: cfg.Routes,
 	}
 
-	routeLimits := map[string]strategy.LimitStrategy{}
+	lim.config.Store(cfg)
 
-	for path, route := range cfg.Routes {
+	if cfg.Admin != nil {
+		lim.adminAddress = cfg.Admin.Address
+		lim.adminKey = cfg.Admin.Key
+	}
 
-		switch route.Strategy {
-		case "token_bucket":
-			routeLimits[path] = &strategy.TokenBucket{
-				Capacity:      route.BucketCap,
-				Created:       time.Now(),
-				Mu:            sync.Mutex{},
-				LastRefill:    map[string]map[string]time.Time{},
-				CurrentTokens: map[string]map[string]int{},
-			}
+	if cfg.Cluster != nil {
+		lim.clusterAddress = cfg.Cluster.Address
+		lim.cluster = cluster.New(cfg, logger, cluster.Handlers{
+			Merge:   lim.mergeDelta,
+			Accept:  lim.acceptForwarded,
+			TopUp:   lim.topUpForwarded,
+			Reset:   lim.resetForwarded,
+			HandOff: lim.handOff,
+		})
+	}
 
-		case "fixed_window":
-			routeLimits[path] = &strategy.FixedWindow{
-				LengthSeconds: route.WindowLength,
-				SqlDb:         db,
-				Logger:        logger,
-				SqlTable:      route.SqlTable,
-			}
-		}
+	lim.routesMu.Lock()
+	defer lim.routesMu.Unlock()
+
+	if err := lim.rebuildRoutes(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load routes: %w", err)
 	}
 
-	if len(routeLimits) != 0 {
-		lim.routeLimits = routeLimits
+	if err := lim.restoreBuckets(); err != nil {
+		lim.logger.WriteError(fmt.Errorf("failed to restore the token buckets, starting with empty buckets: %w", err))
 	}
 
+	metrics.Set(metricTrackedKeys, expvar.Func(lim.trackedKeys))
+
 	return lim, nil
 
 }
@@ -100,111 +167,176 @@ func (l *Limiter) Run(ctx context.Context) error {
 	}()
 	fmt.Println("API gateway running on " + l.address)
 
+	go l.userIdCache.Run(ctx)
+	go l.watchUserChanges(ctx)
+	go l.runBucketSnapshots(ctx)
+	go l.runWindowJanitor(ctx)
+	go l.runCounterFlush(ctx)
+
+	var adminSrv *http.Server
+	if l.adminAddress != "" {
+		adminSrv = &http.Server{
+			Addr:    l.adminAddress,
+			Handler: l.newAdminMux(),
+		}
+
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		fmt.Println("Admin API running on " + l.adminAddress)
+	}
+
+	var clusterSrv *http.Server
+	if l.cluster != nil {
+		clusterSrv = &http.Server{
+			Addr:    l.clusterAddress,
+			Handler: l.cluster.Handler(),
+		}
+
+		go func() {
+			if err := clusterSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		go l.cluster.Run(ctx)
+		fmt.Println("Cluster listener running on " + l.clusterAddress)
+	}
+
 	<-ctx.Done()
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	return srv.Shutdown(shutdownCtx)
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			l.logger.WriteError(fmt.Errorf("admin server shutdown: %w", err))
+		}
+	}
+	if clusterSrv != nil {
+		if err := clusterSrv.Shutdown(shutdownCtx); err != nil {
+			l.logger.WriteError(fmt.Errorf("cluster server shutdown: %w", err))
+		}
+	}
+
+	err := srv.Shutdown(shutdownCtx)
+
+	// after the listener is closed, so the snapshot includes the last requests
+	if err := l.saveBuckets(); err != nil {
+		l.logger.WriteError(fmt.Errorf("failed to save the token buckets: %w", err))
+	}
+	if err := l.store.FlushCounters(context.Background()); err != nil {
+		l.logger.WriteError(fmt.Errorf("failed to write the fixed window counts: %w", err))
+	}
+
+	return err
 
 }
 
 // ServeHTTP is the main handler that processes incoming HTTP requests and applies rate limiting.
 func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	ip := l.authGuard.clientIP(r)
+	if lockedFor := l.authGuard.lockedFor(ip); lockedFor > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockedFor.Seconds())+1))
+		http.Error(w, respAuthLockedOut, http.StatusTooManyRequests)
+		return
+	}
+
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		l.logger.WriteError(errUnauthorized)
-		http.Error(w, respUnauthorized, http.StatusUnauthorized)
+		l.rejectUnauthorized(w, ip)
 		return
 	}
 
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		l.logger.WriteError(errUnauthorized)
-		http.Error(w, respUnauthorized, http.StatusUnauthorized)
+		l.rejectUnauthorized(w, ip)
 		return
 	}
 
 	userId := strings.TrimPrefix(authHeader, "Bearer ")
 	if userId == "" {
-		l.logger.WriteError(errUnauthorized)
-		http.Error(w, respUnauthorized, http.StatusUnauthorized)
+		l.rejectUnauthorized(w, ip)
 		return
 	}
 
-	if !l.isValidUser(userId) {
-		l.logger.WriteError(errUnauthorized)
-		http.Error(w, respUnauthorized, http.StatusUnauthorized)
+	rate, valid, err := l.lookupUser(userId)
+	if err != nil {
+		// not the client's fault, so not a failed attempt
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, respUserLookupFailed, http.StatusServiceUnavailable)
 		return
 	}
-
-	// user quota update
-	if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/users/") {
-
-		if !isAdmin(userId) {
-			http.Error(w, respUnauthorized, http.StatusUnauthorized)
-			return
-		}
-
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) < 3 {
-			http.Error(w, respBadRequest, http.StatusBadRequest)
-			return
-		}
-		victimId := parts[2]
-
-		byteSlc, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, respBadRequest, http.StatusBadRequest)
-			return
-		}
-
-		data := struct {
-			Rate float64 `json:"rate"`
-		}{}
-
-		if err := json.Unmarshal(byteSlc, &data); err != nil {
-			http.Error(w, respBadRequest, http.StatusBadRequest)
-			return
-		}
-
-		if err := l.updateUserQuota(victimId, data.Rate); err != nil {
-			http.Error(w, respInternalServer, http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "{userId: %s, rate: %.3f}", victimId, data.Rate)
+	if !valid {
+		l.rejectUnauthorized(w, ip)
 		return
 	}
 
-	algo := l.routeLimits[r.URL.Path]
+	route := l.lookupRoute(r.URL.Path)
 
-	if algo == nil {
+	if route == nil {
 		l.logger.WriteError(errNotFound)
 		http.Error(w, respNotFound, http.StatusNotFound)
 		return
 	}
 
-	if !algo.Accept(userId, l.userIdCache.GetRate(userId), r.URL.Path) {
+	accepted, err := route.limit.Accept(userId, rate, r.URL.Path)
+	if err != nil {
+		// the backend failed, the route policy decides instead of the limits
+		metrics.Add(metricLimiterErrors, 1)
+		l.logger.WriteError(fmt.Errorf("%w for %s, user %s: %w", errLimiterFailed, r.URL.Path, userId, err))
+
+		if route.OnError != config.OnErrorAllow {
+			metrics.Add(metricFailedClosed, 1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, respLimiterFailed, http.StatusServiceUnavailable)
+			return
+		}
+		metrics.Add(metricFailedOpen, 1)
+		accepted = true
+	}
+
+	if !accepted {
 		l.logger.WriteError(errRateLimitExceeded)
+		metrics.Add(metricRequestsLimited, 1)
 		http.Error(w, respRateLimitExceeded, http.StatusTooManyRequests)
 		return
 	}
+	metrics.Add(metricRequestsAccepted, 1)
 
 	l.sendToAPI(w, r)
 
 }
 
+// rejectUnauthorized responds with 401 and records the failed attempt for the client.
+// The client is locked out once it reaches the maximum number of failed attempts.
+func (l *Limiter) rejectUnauthorized(w http.ResponseWriter, ip string) {
+	l.logger.WriteError(errUnauthorized)
+	metrics.Add(metricAuthFailures, 1)
+	if lockout := l.authGuard.fail(ip); lockout > 0 {
+		metrics.Add(metricAuthLockouts, 1)
+		l.logger.WriteError(fmt.Errorf("%w: client %s locked out for %s", errAuthLockout, ip, lockout))
+	}
+	http.Error(w, respUnauthorized, http.StatusUnauthorized)
+}
+
 // Stop performs any necessary cleanup for the Limiter.
 func (l *Limiter) Stop() {
 	l.logger.WriteInfo("Shutting down limiter...")
 	l.logger.Close()
-	l.sqlDb.Close()
+	l.store.Close()
+	if l.redis != nil {
+		l.redis.Close()
+	}
 }
 
 func (l *Limiter) sendToAPI(w http.ResponseWriter, r *http.Request) {
-	req, err := http.NewRequest(r.Method, l.apiAddress, r.Body)
+	l.settingsMu.RLock()
+	apiAddress, apiKey := l.apiAddress, l.apiKey
+	l.settingsMu.RUnlock()
+
+	req, err := http.NewRequest(r.Method, apiAddress, r.Body)
 	if err != nil {
 		l.logger.WriteError(fmt.Errorf("internal server error: %w", err))
 		http.Error(w, respInternalServer, http.StatusInternalServerError)
@@ -215,7 +347,7 @@ func (l *Limiter) sendToAPI(w http.ResponseWriter, r *http.Request) {
 
 	gatewayToken := r.Header.Get("Authorization")
 
-	apiToken := gatewayToken + ":" + l.apiKey
+	apiToken := gatewayToken + ":" + apiKey.Reveal()
 
 	req.Header.Add("Authorization", apiToken)
 
@@ -237,27 +369,46 @@ func (l *Limiter) sendToAPI(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
+// lookupUser returns the request rate of a user, and whether the user is valid.
+// Database errors are returned, and logged, apart from unknown users.
 // First, the user is looked up in the cache.
-// If not found, the user is looked up in the persistent database.
-// If found in the database, the user is added to the cache for future requests.
-func (l *Limiter) isValidUser(userId string) bool {
+// Ids recently found missing are rejected without querying the database.
+// If not found, the user is looked up in the persistent database. Suspended users are not valid.
+// Concurrent lookups of the same user share a single query.
+// If found in the database, the user is added to the cache for future requests,
+// unless the user was changed while the query ran.
+func (l *Limiter) lookupUser(userId string) (float64, bool, error) {
 	quota := l.userIdCache.GetRate(userId)
 	if quota > 0 {
-		return true
+		return quota, true, nil
 	}
 
-	if err := l.sqlDb.QueryRow("SELECT quota FROM users WHERE id = ?", userId).Scan(&quota); err != nil {
-		if err != sql.ErrNoRows {
-			l.logger.WriteError(fmt.Errorf("database error: %w", err))
-		}
-		return false
+	if l.userIdCache.IsUnknown(userId) {
+		return 0, false, nil
 	}
 
-	l.userIdCache.Add(userId, quota)
+	result, err, _ := l.userLookups.Do(userId, func() (any, error) {
+		// read before the query, so a change of the user during the query isn't undone
+		generation := l.userIdCache.Generation(userId)
+		quota, err := l.userQuota(context.Background(), userId)
+		if err != nil {
+			if err == storage.ErrUserNotFound {
+				l.userIdCache.AddUnknown(userId, generation)
+			}
+			return 0.0, err
+		}
 
-	return true
-}
+		l.userIdCache.AddLookedUp(userId, quota, generation)
+		return quota, nil
+	})
+	if err == storage.ErrUserNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errUserLookupFailed, err)
+		l.logger.WriteError(err)
+		return 0, false, err
+	}
 
-func isAdmin(userId string) bool {
-	return userId == "0"
+	return result.(float64), true, nil
 }
@@ -0,0 +1,202 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gateway/pkg/config"
+	"gateway/pkg/migrations"
+	"gateway/pkg/storage"
+)
+
+// newTestLimiter creates a limiter on a migrated SQLite database, with the seeded users,
+// a /foo fixed window route where user 0 can make 1000 requests, and an API that answers every request with 200.
+// The gateway block of the configuration can be extended with settings.
+func newTestLimiter(t *testing.T, settings string) *Limiter {
+	t.Helper()
+	ctx := context.Background()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(api.Close)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gateway.hcl")
+	src := fmt.Sprintf(`
+gateway {
+  address  = "localhost:0"
+  log_file = "gateway.log"
+  db_file  = "limiter.db"
+  %s
+}
+api {
+  address = %q
+  key     = "api-key"
+}
+routes {
+  path        = "/foo"
+  strategy    = "fixed_window"
+  window_size = 100
+  sql_table   = "request_count"
+}
+`, settings, api.URL)
+	if err := os.WriteFile(file, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := config.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := raw.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrations.New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	l, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Stop)
+	return l
+}
+
+// get sends a request to /foo with a bearer token, from the given client address, and returns the status.
+func get(l *Limiter, token string, remoteAddr string) int {
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestSuccessfulAuthDoesntClearFailures(t *testing.T) {
+	l := newTestLimiter(t, "auth_max_failures = 10")
+
+	// a valid token after every few failures, like a client guessing tokens with a valid one
+	for i := range 9 {
+		if code := get(l, "unknown", "10.0.0.1:1234"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want %d", i+1, code, http.StatusUnauthorized)
+		}
+		if code := get(l, "0", "10.0.0.1:1234"); code != http.StatusOK {
+			t.Fatalf("success %d: status = %d, want %d", i+1, code, http.StatusOK)
+		}
+	}
+
+	if code := get(l, "unknown", "10.0.0.1:1234"); code != http.StatusUnauthorized {
+		t.Fatalf("failure 10: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := get(l, "0", "10.0.0.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("after 10 failures: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// other clients aren't locked out
+	if code := get(l, "0", "10.0.0.2:1234"); code != http.StatusOK {
+		t.Errorf("other client: status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestUserLookupErrorsArentAuthFailures(t *testing.T) {
+	l := newTestLimiter(t, "auth_max_failures = 3")
+
+	// the database is down
+	l.store.Close()
+
+	for i := range 5 {
+		if code := get(l, "1", "10.0.0.1:1234"); code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: status = %d, want %d", i+1, code, http.StatusServiceUnavailable)
+		}
+	}
+	if lockedFor := l.authGuard.lockedFor("10.0.0.1"); lockedFor != 0 {
+		t.Errorf("client locked out for %s after database errors", lockedFor)
+	}
+}
+
+// pauseUserQuota makes the next database lookup of lookupUser wait after its query, until release is closed.
+// started is closed once the query has read the user.
+func pauseUserQuota(l *Limiter) (started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+	userQuota := l.userQuota
+	var once sync.Once
+	l.userQuota = func(ctx context.Context, userId string) (float64, error) {
+		quota, err := userQuota(ctx, userId)
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return quota, err
+	}
+	return started, release
+}
+
+func TestUserChangeDuringLookupIsKept(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, "")
+
+	// the lookup reads the rate of user 1, then the rate is changed before the lookup caches it
+	started, release := pauseUserQuota(l)
+	done := make(chan float64)
+	go func() {
+		rate, _, _ := l.lookupUser("1")
+		done <- rate
+	}()
+	<-started
+
+	rate := 7.0
+	if _, err := l.updateUser(ctx, "1", nil, &rate); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if stale := <-done; stale != 0.5 {
+		t.Fatalf("paused lookup returned %v, want the rate it read, 0.5", stale)
+	}
+
+	if got, valid, err := l.lookupUser("1"); err != nil || !valid || got != 7 {
+		t.Errorf("lookupUser = %v, %v, %v, want the changed rate 7", got, valid, err)
+	}
+}
+
+func TestUserCreatedDuringLookupIsKept(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, "")
+
+	// the lookup finds user 42 missing, then the user is created before the lookup marks it unknown
+	started, release := pauseUserQuota(l)
+	done := make(chan bool)
+	go func() {
+		_, valid, _ := l.lookupUser("42")
+		done <- valid
+	}()
+	<-started
+
+	if err := l.createUser(ctx, &storage.User{Id: 42, Name: "new", Rate: 3}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if <-done {
+		t.Fatal("paused lookup found the user it read as missing")
+	}
+
+	if got, valid, err := l.lookupUser("42"); err != nil || !valid || got != 3 {
+		t.Errorf("lookupUser = %v, %v, %v, want the created user with rate 3", got, valid, err)
+	}
+}
@@ -5,6 +5,9 @@ const (
 	respBadRequest        = "{error: 'bad request'}"
 	respNotFound          = "{error: 'not found'}"
 	respRateLimitExceeded = "{error: 'rate limit exceeded'}"
+	respAuthLockedOut     = "{error: 'too many failed authentication attempts'}"
 	respInternalServer    = "{error: 'internal server error'}"
+	respLimiterFailed     = "{error: 'rate limiter unavailable'}"
+	respUserLookupFailed  = "{error: 'user lookup unavailable'}"
 	respSuccess           = "{success: true}"
 )
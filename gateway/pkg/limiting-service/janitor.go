@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/config"
+	"sort"
+	"time"
+)
+
+// runCounterFlush writes the fixed window counts waiting in memory every flush interval, until the context is done.
+// It returns right away if the counts are written on every request.
+func (l *Limiter) runCounterFlush(ctx context.Context) {
+	if l.config.Load().WindowFlushInterval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.config.Load().WindowFlushInterval):
+		}
+
+		if err := l.store.FlushCounters(ctx); err != nil {
+			l.logger.WriteError(fmt.Errorf("failed to write the fixed window counts: %w", err))
+		}
+	}
+}
+
+// runWindowJanitor deletes the expired fixed window counts every cleanup interval, until the context is done.
+func (l *Limiter) runWindowJanitor(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.config.Load().WindowCleanupInterval):
+		}
+
+		l.deleteExpiredWindows(ctx)
+	}
+}
+
+// deleteExpiredWindows deletes, from each table used by a fixed window route with the sql backend,
+// the windows that ended more than the retention ago.
+// Routes sharing a table may have different window lengths, so the longest one is used for the table.
+// The space of the deleted counts is then returned to the file system, on SQLite.
+func (l *Limiter) deleteExpiredWindows(ctx context.Context) {
+	windows := map[string]int{} // table -> longest window length, in seconds
+	for _, r := range l.listRoutes() {
+		if r.Strategy == "fixed_window" && r.Backend == config.BackendSQL {
+			windows[r.SqlTable] = max(windows[r.SqlTable], r.WindowLength)
+		}
+	}
+
+	tables := make([]string, 0, len(windows))
+	for table := range windows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	retention := l.config.Load().WindowRetention
+	var total int64
+	for _, table := range tables {
+		before := time.Now().Add(-retention).Unix() - int64(windows[table])
+
+		deleted, err := l.store.Counters(table).DeleteBefore(ctx, before)
+		if err != nil {
+			l.logger.WriteError(fmt.Errorf("failed to delete the expired windows of %s: %w", table, err))
+			continue
+		}
+
+		total += deleted
+		metrics.Add(metricWindowsDeleted, deleted)
+		if deleted > 0 {
+			l.logger.WriteInfo(fmt.Sprintf("deleted %d expired windows from %s", deleted, table))
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	pages, err := l.store.ReclaimSpace(ctx)
+	if err != nil {
+		l.logger.WriteError(fmt.Errorf("failed to reclaim the space of the expired windows: %w", err))
+		return
+	}
+	metrics.Add(metricPagesReclaimed, pages)
+}
@@ -0,0 +1,43 @@
+package limiter
+
+import (
+	"expvar"
+	"gateway/pkg/strategy"
+)
+
+// metrics holds the gateway counters, published under "gateway" at /debug/vars on the admin listener.
+var metrics = expvar.NewMap("gateway")
+
+const (
+	metricRequestsAccepted = "requests_accepted"
+	metricRequestsLimited  = "requests_limited"
+	metricLimiterErrors    = "limiter_errors"
+	metricFailedOpen       = "requests_failed_open"
+	metricFailedClosed     = "requests_failed_closed"
+	metricAuthFailures     = "auth_failures"
+	metricAuthLockouts     = "auth_lockouts"
+
+	metricUserCacheHits          = "user_cache_hits"
+	metricUserCacheMisses        = "user_cache_misses"
+	metricUserCacheEvictions     = "user_cache_evictions"
+	metricNegativeCacheEvictions = "negative_cache_evictions"
+	metricUserCacheExpirations   = "user_cache_expirations"
+	metricUserCacheInvalidations = "user_cache_invalidations"
+	metricUserCacheStaleLookups  = "user_cache_stale_lookups"
+
+	metricTrackedKeys = "tracked_keys"
+
+	metricWindowsDeleted = "fixed_windows_deleted"
+	metricPagesReclaimed = "db_pages_reclaimed"
+)
+
+// trackedKeys returns the number of users kept in memory by the strategy of each route, for the strategies that report it.
+func (l *Limiter) trackedKeys() any {
+	keys := map[string]int{}
+	for _, r := range l.listRoutes() {
+		if tracker, ok := r.limit.(strategy.KeyTracker); ok {
+			keys[r.Path] = tracker.TrackedKeys()
+		}
+	}
+	return keys
+}
@@ -0,0 +1,176 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/config"
+	"gateway/pkg/strategy"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reload loads a new configuration with load and applies it to the running limiter.
+// If loading fails, the current configuration is kept.
+// Routes, the log level, cache TTLs, token bucket limits, auth lockout settings, the API address and key and the admin key are applied.
+// Routes that didn't change keep their limiting state.
+// Changes to the listener addresses, the log file, the database, redis and cluster settings need a restart, they are only logged.
+func (l *Limiter) Reload(ctx context.Context, load func() (*config.Config, error)) error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	cfg, err := load()
+	if err != nil {
+		err = fmt.Errorf("config reload failed, keeping the current config: %w", err)
+		l.logger.WriteError(err)
+		return err
+	}
+
+	l.routesMu.Lock()
+	oldRoutes := l.configRoutes
+	l.configRoutes = cfg.Routes
+	if err := l.rebuildRoutes(ctx); err != nil {
+		l.configRoutes = oldRoutes
+		l.routesMu.Unlock()
+
+		err = fmt.Errorf("config reload failed, keeping the current config: %w", err)
+		l.logger.WriteError(err)
+		return err
+	}
+	for _, r := range l.listRoutes() {
+		switch limit := r.limit.(type) {
+		case *strategy.TokenBucket:
+			limit.Configure(cfg.BucketIdleTimeout, cfg.BucketMaxKeys)
+		case *strategy.ClusterTokenBucket:
+			limit.Configure(cfg.BucketIdleTimeout)
+		case *strategy.RingTokenBucket:
+			limit.Configure(cfg.BucketIdleTimeout)
+		}
+	}
+	l.routesMu.Unlock()
+
+	l.logger.SetLevel(cfg.LogLevel)
+	l.userIdCache.configure(cfg.UserCacheSize, cfg.NegativeCacheSize, cfg.UserCacheTTL*time.Minute, cfg.NegativeCacheTTL)
+	l.authGuard.configure(cfg.AuthMaxFailures, cfg.AuthLockout, cfg.TrustedProxies)
+
+	l.settingsMu.Lock()
+	l.apiAddress = cfg.Api.Address
+	l.apiKey = cfg.Api.Key
+	if cfg.Admin != nil {
+		l.adminKey = cfg.Admin.Key
+	}
+	l.settingsMu.Unlock()
+
+	for _, setting := range l.restartRequired(cfg) {
+		l.logger.WriteError(fmt.Errorf("config reload: %s changed, a restart is needed to apply it", setting))
+	}
+
+	l.config.Store(l.effectiveConfig(cfg))
+
+	added, changed, removed := diffRoutes(oldRoutes, cfg.Routes)
+	l.logger.WriteInfo(fmt.Sprintf("config reloaded: routes added [%s], changed [%s], removed [%s]",
+		strings.Join(added, " "), strings.Join(changed, " "), strings.Join(removed, " ")))
+
+	return nil
+}
+
+// restartRequired returns the settings of cfg that differ from the running ones but can't be applied at runtime.
+func (l *Limiter) restartRequired(cfg *config.Config) []string {
+	settings := []string{}
+
+	if cfg.Address != l.address {
+		settings = append(settings, "gateway address")
+	}
+	if cfg.LogFile != l.logFile {
+		settings = append(settings, "log_file")
+	}
+	if cfg.Storage != l.storage {
+		settings = append(settings, "storage")
+	}
+	if cfg.DBFile != l.dbFile {
+		settings = append(settings, "db_file")
+	}
+	if cfg.DatabaseURL != l.databaseURL {
+		settings = append(settings, "database_url")
+	}
+
+	// the store batches the fixed window counts or not from the start, the interval alone can change
+	if (cfg.WindowFlushInterval > 0) != (l.config.Load().WindowFlushInterval > 0) {
+		settings = append(settings, "window_flush_interval_ms")
+	}
+	if cfg.WindowFlushBatch != l.config.Load().WindowFlushBatch {
+		settings = append(settings, "window_flush_batch")
+	}
+
+	running := l.config.Load().Redis
+	if (cfg.Redis == nil) != (running == nil) || cfg.Redis != nil && *cfg.Redis != *running {
+		settings = append(settings, "redis")
+	}
+
+	if !cfg.Cluster.Equal(l.config.Load().Cluster) {
+		settings = append(settings, "cluster")
+	}
+
+	adminAddress := ""
+	if cfg.Admin != nil {
+		adminAddress = cfg.Admin.Address
+	}
+	if adminAddress != l.adminAddress {
+		settings = append(settings, "admin address")
+	}
+
+	return settings
+}
+
+// effectiveConfig returns a copy of a reloaded configuration, with the settings that need a restart
+// set to the running values.
+func (l *Limiter) effectiveConfig(cfg *config.Config) *config.Config {
+	effective := *cfg
+	effective.Address = l.address
+	effective.LogFile = l.logFile
+	effective.Storage = l.storage
+	effective.DBFile = l.dbFile
+	effective.DatabaseURL = l.databaseURL
+	effective.Redis = l.config.Load().Redis
+	effective.Cluster = l.config.Load().Cluster
+	effective.WindowFlushBatch = l.config.Load().WindowFlushBatch
+	if (cfg.WindowFlushInterval > 0) != (l.config.Load().WindowFlushInterval > 0) {
+		effective.WindowFlushInterval = l.config.Load().WindowFlushInterval
+	}
+
+	if admin := l.config.Load().Admin; admin != nil {
+		adminConf := *admin
+		if cfg.Admin != nil {
+			adminConf.Key = cfg.Admin.Key
+		}
+		effective.Admin = &adminConf
+	} else {
+		effective.Admin = nil
+	}
+
+	return &effective
+}
+
+// diffRoutes returns the sorted paths of the routes added, changed and removed between two route sets.
+func diffRoutes(old, new map[string]config.RouteConfig) (added, changed, removed []string) {
+	for path, routeConf := range new {
+		oldConf, found := old[path]
+		switch {
+		case !found:
+			added = append(added, path)
+		case oldConf != routeConf:
+			changed = append(changed, path)
+		}
+	}
+
+	for path := range old {
+		if _, found := new[path]; !found {
+			removed = append(removed, path)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+	return added, changed, removed
+}
@@ -0,0 +1,346 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/cluster"
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+	"gateway/pkg/strategy"
+	"sort"
+	"time"
+)
+
+const (
+	routeSourceConfig = "config"
+	routeSourceAdmin  = "admin"
+)
+
+// route is a rate limited path, with its settings and limiting strategy.
+type route struct {
+	Path   string `json:"path"`
+	Source string `json:"source"` // config or admin
+	config.RouteConfig
+
+	limit strategy.LimitStrategy
+}
+
+// routeTable maps paths to routes. A table is never modified once published,
+// changes are made on a copy which then replaces it.
+type routeTable map[string]*route
+
+// lookupRoute returns the route serving a path, or nil if the path is not rate limited.
+func (l *Limiter) lookupRoute(path string) *route {
+	return (*l.routes.Load())[path]
+}
+
+// listRoutes returns the current routes, sorted by path.
+func (l *Limiter) listRoutes() []*route {
+	table := *l.routes.Load()
+
+	routes := make([]*route, 0, len(table))
+	for _, r := range table {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Path < routes[j].Path
+	})
+	return routes
+}
+
+// saveRoute creates or replaces a route and persists it as an override.
+// If create is set, it fails with errRouteExists instead of replacing a route.
+func (l *Limiter) saveRoute(ctx context.Context, path string, routeConf config.RouteConfig, create bool) (*route, error) {
+	if err := config.DiagnosticsError(routeConf.Validate(path)); err != nil {
+		return nil, err
+	}
+
+	if routeConf.Backend == config.BackendRedis && l.redis == nil {
+		return nil, errRedisNotConfigured
+	}
+	if (routeConf.Backend == config.BackendCluster || routeConf.Backend == config.BackendRing) && l.cluster == nil {
+		return nil, errClusterNotConfigured
+	}
+	if routeConf.Backend == config.BackendSQL {
+		if err := l.checkTable(ctx, routeConf.SqlTable); err != nil {
+			return nil, err
+		}
+	}
+
+	l.routesMu.Lock()
+	defer l.routesMu.Unlock()
+
+	if create && l.lookupRoute(path) != nil {
+		return nil, errRouteExists
+	}
+
+	err := l.store.SaveRouteOverride(ctx, storage.RouteOverride{
+		Path:   path,
+		Config: routeConf,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.rebuildRoutes(ctx); err != nil {
+		return nil, err
+	}
+	return l.lookupRoute(path), nil
+}
+
+// deleteRoute removes a route and persists the removal as an override.
+func (l *Limiter) deleteRoute(ctx context.Context, path string) error {
+	l.routesMu.Lock()
+	defer l.routesMu.Unlock()
+
+	if l.lookupRoute(path) == nil {
+		return errRouteNotFound
+	}
+
+	err := l.store.SaveRouteOverride(ctx, storage.RouteOverride{
+		Path:    path,
+		Deleted: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return l.rebuildRoutes(ctx)
+}
+
+// rebuildRoutes merges the configured routes with the persisted overrides and publishes the result.
+// Routes whose limits didn't change keep their strategy, and with it their limiting state.
+// Changing only the on_error policy of a route keeps its strategy.
+// The caller must hold routesMu.
+func (l *Limiter) rebuildRoutes(ctx context.Context) error {
+	overrides, err := l.store.RouteOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	sources := map[string]string{}
+	configs := map[string]config.RouteConfig{}
+	for path, routeConf := range l.configRoutes {
+		configs[path] = routeConf
+		sources[path] = routeSourceConfig
+	}
+
+	for _, override := range overrides {
+		if override.Deleted {
+			delete(configs, override.Path)
+			continue
+		}
+		configs[override.Path] = override.Config
+		sources[override.Path] = routeSourceAdmin
+	}
+
+	var current routeTable
+	if table := l.routes.Load(); table != nil {
+		current = *table
+	}
+
+	table := routeTable{}
+	for path, routeConf := range configs {
+		if routeConf.Backend == config.BackendRedis && l.redis == nil {
+			return fmt.Errorf("route %s: %w", path, errRedisNotConfigured)
+		}
+		if (routeConf.Backend == config.BackendCluster || routeConf.Backend == config.BackendRing) && l.cluster == nil {
+			return fmt.Errorf("route %s: %w", path, errClusterNotConfigured)
+		}
+
+		r := &route{
+			Path:        path,
+			Source:      sources[path],
+			RouteConfig: routeConf,
+		}
+
+		if old, found := current[path]; found && sameLimits(old.RouteConfig, routeConf) {
+			r.limit = old.limit
+		} else {
+			r.limit = l.newStrategy(routeConf)
+		}
+
+		table[path] = r
+	}
+
+	l.routes.Store(&table)
+	return nil
+}
+
+// sameLimits reports whether two route settings use the same strategy with the same limits.
+func sameLimits(a, b config.RouteConfig) bool {
+	a.OnError, b.OnError = "", ""
+	return a == b
+}
+
+// newStrategy creates the limiting strategy of a route.
+// Redis, cluster and ring routes need the redis client and the cluster node, which rebuildRoutes checks.
+func (l *Limiter) newStrategy(routeConf config.RouteConfig) strategy.LimitStrategy {
+	switch routeConf.Backend {
+	case config.BackendRedis:
+		return l.newRedisStrategy(routeConf)
+	case config.BackendCluster:
+		return l.newClusterStrategy(routeConf)
+	case config.BackendRing:
+		return l.newRingStrategy(routeConf)
+	}
+
+	switch routeConf.Strategy {
+	case "token_bucket":
+		cfg := l.config.Load()
+		return &strategy.TokenBucket{
+			Capacity:    routeConf.BucketCap,
+			Created:     time.Now(),
+			IdleTimeout: cfg.BucketIdleTimeout,
+			MaxKeys:     cfg.BucketMaxKeys,
+		}
+
+	case "fixed_window":
+		return &strategy.FixedWindow{
+			LengthSeconds: routeConf.WindowLength,
+			Counters:      l.store.Counters(routeConf.SqlTable),
+		}
+	}
+
+	return nil
+}
+
+// newRedisStrategy creates the limiting strategy of a route using the redis backend.
+func (l *Limiter) newRedisStrategy(routeConf config.RouteConfig) strategy.LimitStrategy {
+	keyPrefix := l.config.Load().Redis.KeyPrefix
+
+	switch routeConf.Strategy {
+	case "token_bucket":
+		return &strategy.RedisTokenBucket{
+			Capacity:  routeConf.BucketCap,
+			Client:    l.redis,
+			KeyPrefix: keyPrefix,
+		}
+
+	case "fixed_window":
+		return &strategy.RedisFixedWindow{
+			LengthSeconds: routeConf.WindowLength,
+			Client:        l.redis,
+			KeyPrefix:     keyPrefix,
+		}
+
+	case "sliding_window":
+		return &strategy.RedisSlidingWindow{
+			LengthSeconds: routeConf.WindowLength,
+			Client:        l.redis,
+			KeyPrefix:     keyPrefix,
+		}
+	}
+
+	return nil
+}
+
+// newClusterStrategy creates the limiting strategy of a route using the cluster backend.
+func (l *Limiter) newClusterStrategy(routeConf config.RouteConfig) strategy.LimitStrategy {
+	switch routeConf.Strategy {
+	case "token_bucket":
+		return &strategy.ClusterTokenBucket{
+			Capacity:    routeConf.BucketCap,
+			Node:        l.cluster,
+			IdleTimeout: l.config.Load().BucketIdleTimeout,
+		}
+
+	case "fixed_window":
+		return &strategy.ClusterFixedWindow{
+			LengthSeconds: routeConf.WindowLength,
+			Node:          l.cluster,
+		}
+	}
+
+	return nil
+}
+
+// newRingStrategy creates the limiting strategy of a route using the ring backend.
+func (l *Limiter) newRingStrategy(routeConf config.RouteConfig) strategy.LimitStrategy {
+	switch routeConf.Strategy {
+	case "token_bucket":
+		return &strategy.RingTokenBucket{
+			Capacity:    routeConf.BucketCap,
+			Node:        l.cluster,
+			Logger:      l.logger,
+			IdleTimeout: l.config.Load().BucketIdleTimeout,
+		}
+
+	case "fixed_window":
+		return &strategy.RingFixedWindow{
+			LengthSeconds: routeConf.WindowLength,
+			Node:          l.cluster,
+			Logger:        l.logger,
+		}
+	}
+
+	return nil
+}
+
+// mergeDelta passes the requests accepted by a cluster peer to the strategy of their route.
+// Deltas for routes that don't use the cluster backend on this gateway are dropped.
+func (l *Limiter) mergeDelta(d cluster.Delta) {
+	route := l.lookupRoute(d.Path)
+	if route == nil {
+		return
+	}
+	if merger, ok := route.limit.(strategy.Merger); ok {
+		merger.Merge(d.UserId, d.Path, d.Window, d.Count)
+	}
+}
+
+// acceptForwarded decides on a request forwarded by the cluster peer that received it.
+// found is false if the route doesn't use the ring backend on this gateway.
+func (l *Limiter) acceptForwarded(path string, userId string, rate float64) (bool, bool) {
+	route := l.lookupRoute(path)
+	if route == nil {
+		return false, false
+	}
+	owner, ok := route.limit.(strategy.RingOwner)
+	if !ok {
+		return false, false
+	}
+	return owner.AcceptOwned(userId, rate, path), true
+}
+
+// topUpForwarded grants additional requests to a user owned by this gateway, for the cluster peer that received the top-up.
+// It returns false if the route doesn't use the ring backend on this gateway.
+func (l *Limiter) topUpForwarded(path string, userId string, amount int) bool {
+	route := l.lookupRoute(path)
+	if route == nil {
+		return false
+	}
+	owner, ok := route.limit.(strategy.RingOwner)
+	if !ok {
+		return false
+	}
+	owner.TopUpOwned(userId, path, amount)
+	return true
+}
+
+// resetForwarded clears the state of a user owned by this gateway, for the cluster peer that received the reset.
+// It returns false if the route doesn't use the ring backend on this gateway.
+func (l *Limiter) resetForwarded(path string, userId string) bool {
+	route := l.lookupRoute(path)
+	if route == nil {
+		return false
+	}
+	owner, ok := route.limit.(strategy.RingOwner)
+	if !ok {
+		return false
+	}
+	owner.ResetOwned(userId, path)
+	return true
+}
+
+// handOff removes the state of a user now owned by another cluster peer, and returns it.
+func (l *Limiter) handOff(path string, userId string) *cluster.KeyState {
+	route := l.lookupRoute(path)
+	if route == nil {
+		return nil
+	}
+	if owner, ok := route.limit.(strategy.RingOwner); ok {
+		return owner.HandOff(userId, path)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/pkg/strategy"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bucketSnapshot is the content of the bucket snapshot file.
+type bucketSnapshot struct {
+	SavedAt time.Time                          `json:"saved_at"`
+	Routes  map[string]strategy.BucketSnapshot `json:"routes"` // path -> buckets
+}
+
+// restoreBuckets restores the in-memory token buckets from the snapshot file, if it is configured and exists.
+// Routes that no longer use the in-memory token bucket strategy are skipped.
+func (l *Limiter) restoreBuckets() error {
+	file := l.config.Load().BucketSnapshotFile
+	if file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot bucketSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid bucket snapshot %s: %w", file, err)
+	}
+
+	restored := 0
+	for path, buckets := range snapshot.Routes {
+		route := l.lookupRoute(path)
+		if route == nil {
+			continue
+		}
+		if tb, ok := route.limit.(*strategy.TokenBucket); ok {
+			tb.Restore(buckets)
+			restored += len(buckets.Buckets)
+		}
+	}
+
+	l.logger.WriteInfo(fmt.Sprintf("restored %d token buckets from %s, saved at %s",
+		restored, file, snapshot.SavedAt.Format(time.RFC3339)))
+	return nil
+}
+
+// saveBuckets writes the in-memory token buckets to the snapshot file, if it is configured.
+// The file is replaced atomically, so a crash while saving leaves the previous snapshot.
+func (l *Limiter) saveBuckets() error {
+	file := l.config.Load().BucketSnapshotFile
+	if file == "" {
+		return nil
+	}
+
+	snapshot := bucketSnapshot{SavedAt: time.Now(), Routes: map[string]strategy.BucketSnapshot{}}
+	for _, r := range l.listRoutes() {
+		if tb, ok := r.limit.(*strategy.TokenBucket); ok {
+			snapshot.Routes[r.Path] = tb.Snapshot()
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// runBucketSnapshots saves the token buckets every snapshot interval until the context is done.
+func (l *Limiter) runBucketSnapshots(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.config.Load().BucketSnapshotInterval):
+		}
+
+		if err := l.saveBuckets(); err != nil {
+			l.logger.WriteError(fmt.Errorf("failed to save the token buckets: %w", err))
+		}
+	}
+}
@@ -1,11 +1,33 @@
 package limiter
 
-import "time"
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
 
-// UserCache is a simple in-memory cache for user request rates with TTL.
+// userCacheSweepInterval is how often expired users are removed from the cache.
+const userCacheSweepInterval = time.Minute
+
+// UserCache is an in-memory cache for user request rates with TTL, safe for concurrent use.
+// Unknown user ids are cached separately, so repeated lookups of
+// invalid credentials don't reach the database.
+// Users and unknown ids have LRUs of their own size, so a flood of invalid credentials doesn't evict users.
+//
+// Every invalidation of a user id bumps its generation. A database lookup reads the generation before
+// its query and caches the result only if the generation didn't change, so an invalidation made
+// while the query runs isn't undone by caching what the query read.
 type UserCache struct {
-	data map[string]userData
-	ttl  time.Duration
+	mu          sync.Mutex
+	users       *userLRU
+	unknown     *userLRU // user ids found missing
+	ttl         time.Duration
+	negativeTtl time.Duration
+
+	generation  uint64            // of the last invalidation
+	invalidated map[string]uint64 // generation of the last invalidation of a user id, since the last sweep
+	swept       uint64            // generation of the last sweep, for the user ids not in invalidated
 }
 
 type userData struct {
@@ -14,28 +36,236 @@ type userData struct {
 	created   time.Time
 }
 
-// Add adds a user with their request rate to the cache.
-// If the user already exists, their data is updated.
+// userLRU holds at most maxEntries entries, evicting the least recently used ones.
+type userLRU struct {
+	entries    map[string]*list.Element // userId -> element of lru
+	lru        *list.List               // of *userData, most recently used first
+	maxEntries int
+	evictions  string // name of the evictions metric
+}
+
+func newUserLRU(maxEntries int, evictions string) *userLRU {
+	return &userLRU{entries: map[string]*list.Element{}, lru: list.New(), maxEntries: maxEntries, evictions: evictions}
+}
+
+func newUserCache(maxEntries int, negativeMaxEntries int, ttl time.Duration, negativeTtl time.Duration) *UserCache {
+	return &UserCache{
+		users:       newUserLRU(maxEntries, metricUserCacheEvictions),
+		unknown:     newUserLRU(negativeMaxEntries, metricNegativeCacheEvictions),
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		invalidated: map[string]uint64{},
+	}
+}
+
+// Generation returns the invalidation generation of a user id, for AddLookedUp and AddUnknown.
+func (cache *UserCache) Generation(userId string) uint64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if generation, found := cache.invalidated[userId]; found {
+		return generation
+	}
+	return cache.swept
+}
+
+// Add adds a user with their request rate to the cache, after a change of the user.
+// If the user already exists, their data is updated. Lookups started before are not cached.
 func (cache *UserCache) Add(userId string, reqPerSec float64) {
-	cache.data[userId] = userData{
-		userId:    userId,
-		reqPerSec: reqPerSec,
-		created:   time.Now(),
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.invalidate(userId)
+	cache.unknown.remove(userId)
+	cache.users.set(&userData{userId: userId, reqPerSec: reqPerSec, created: time.Now()})
+}
+
+// AddLookedUp adds a user read from the database by a lookup that started at the given generation.
+// It reports whether the user was added, which it isn't if the user was invalidated since.
+func (cache *UserCache) AddLookedUp(userId string, reqPerSec float64, generation uint64) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.current(userId, generation) {
+		metrics.Add(metricUserCacheStaleLookups, 1)
+		return false
 	}
+	cache.unknown.remove(userId)
+	cache.users.set(&userData{userId: userId, reqPerSec: reqPerSec, created: time.Now()})
+	return true
 }
 
 // GetRate returns the user request rate, if found and not expired
 // Otherwise, 0 is returned
 func (cache *UserCache) GetRate(userId string) float64 {
-	data, exists := cache.data[userId]
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
 
-	if !exists {
+	data := cache.users.get(userId, cache.ttl)
+	if data == nil {
+		metrics.Add(metricUserCacheMisses, 1)
 		return 0
 	}
+	metrics.Add(metricUserCacheHits, 1)
+	return data.reqPerSec
+}
 
-	if time.Since(data.created) > cache.ttl {
-		delete(cache.data, userId)
-		return 0
+// Remove drops any cached data about a user, including a missing mark.
+// Lookups started before are not cached.
+func (cache *UserCache) Remove(userId string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.invalidate(userId)
+	cache.users.remove(userId)
+	cache.unknown.remove(userId)
+}
+
+// invalidate bumps the generation of a user id. The caller must hold the cache lock.
+func (cache *UserCache) invalidate(userId string) {
+	cache.generation++
+	cache.invalidated[userId] = cache.generation
+}
+
+// current reports whether a user id wasn't invalidated since the given generation.
+// The caller must hold the cache lock.
+func (cache *UserCache) current(userId string, generation uint64) bool {
+	if invalidated, found := cache.invalidated[userId]; found {
+		return invalidated == generation
 	}
-	return data.reqPerSec
+	return cache.swept == generation
+}
+
+// configure changes the TTLs and the maximum number of cached users and unknown user ids.
+// If the cache holds more entries than the new maximums, the least recently used ones are evicted.
+func (cache *UserCache) configure(maxEntries int, negativeMaxEntries int, ttl time.Duration, negativeTtl time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.users.maxEntries = maxEntries
+	cache.unknown.maxEntries = negativeMaxEntries
+	cache.ttl = ttl
+	cache.negativeTtl = negativeTtl
+	cache.users.evict()
+	cache.unknown.evict()
+}
+
+// AddUnknown marks a user id as not found in the database by a lookup that started at the given generation.
+// It reports whether the mark was added, which it isn't if the user was invalidated since.
+func (cache *UserCache) AddUnknown(userId string, generation uint64) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.current(userId, generation) {
+		metrics.Add(metricUserCacheStaleLookups, 1)
+		return false
+	}
+	cache.users.remove(userId)
+	cache.unknown.set(&userData{userId: userId, created: time.Now()})
+	return true
+}
+
+// IsUnknown reports whether the user id was recently found missing.
+// Expired entries are removed.
+func (cache *UserCache) IsUnknown(userId string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.unknown.get(userId, cache.negativeTtl) != nil
+}
+
+// Run removes the expired entries every userCacheSweepInterval, until the context is done.
+func (cache *UserCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(userCacheSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cache.sweep()
+		}
+	}
+}
+
+// sweep removes the expired entries.
+// It also forgets the invalidated user ids, so they don't pile up: the lookups in progress,
+// which started before the sweep, are not cached.
+func (cache *UserCache) sweep() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	cache.users.sweep(cache.ttl, now)
+	cache.unknown.sweep(cache.negativeTtl, now)
+
+	clear(cache.invalidated)
+	cache.swept = cache.generation
+}
+
+// get returns the entry of a user id and marks it as the most recently used, or nil if not found or expired.
+// Expired entries are removed. The caller must hold the cache lock.
+func (c *userLRU) get(userId string, ttl time.Duration) *userData {
+	elem, found := c.entries[userId]
+	if !found {
+		return nil
+	}
+
+	data := elem.Value.(*userData)
+	if time.Since(data.created) > ttl {
+		c.drop(elem)
+		metrics.Add(metricUserCacheExpirations, 1)
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	return data
+}
+
+// set adds or replaces the entry of a user id, evicting the least recently used entries if the LRU is full.
+// The caller must hold the cache lock.
+func (c *userLRU) set(data *userData) {
+	if elem, found := c.entries[data.userId]; found {
+		elem.Value = data
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[data.userId] = c.lru.PushFront(data)
+	c.evict()
+}
+
+// evict removes the least recently used entries until the LRU holds at most maxEntries.
+// The caller must hold the cache lock.
+func (c *userLRU) evict() {
+	for c.lru.Len() > c.maxEntries {
+		c.drop(c.lru.Back())
+		metrics.Add(c.evictions, 1)
+	}
+}
+
+// sweep removes the entries older than ttl. The caller must hold the cache lock.
+func (c *userLRU) sweep(ttl time.Duration, now time.Time) {
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if now.Sub(elem.Value.(*userData).created) > ttl {
+			c.drop(elem)
+			metrics.Add(metricUserCacheExpirations, 1)
+		}
+		elem = next
+	}
+}
+
+// remove drops the entry of a user id, if any. The caller must hold the cache lock.
+func (c *userLRU) remove(userId string) {
+	if elem, found := c.entries[userId]; found {
+		c.drop(elem)
+	}
+}
+
+// drop removes an entry. The caller must hold the cache lock.
+func (c *userLRU) drop(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*userData).userId)
 }
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserCacheUnknownIdsDontEvictUsers(t *testing.T) {
+	cache := newUserCache(2, 2, time.Minute, time.Minute)
+	cache.Add("1", 10)
+	cache.Add("2", 20)
+
+	for i := range 100 {
+		userId := "unknown-" + strconv.Itoa(i)
+		cache.AddUnknown(userId, cache.Generation(userId))
+	}
+
+	if rate := cache.GetRate("1"); rate != 10 {
+		t.Errorf("rate of user 1 = %v, want 10", rate)
+	}
+	if rate := cache.GetRate("2"); rate != 20 {
+		t.Errorf("rate of user 2 = %v, want 20", rate)
+	}
+	if !cache.IsUnknown("unknown-99") || cache.IsUnknown("unknown-0") {
+		t.Error("the unknown ids aren't bounded to the 2 most recent ones")
+	}
+
+	// a user created after being found missing
+	cache.Add("unknown-99", 5)
+	if cache.IsUnknown("unknown-99") {
+		t.Error("added user still unknown")
+	}
+}
+
+func TestUserCacheSkipsLookupsOlderThanInvalidation(t *testing.T) {
+	cache := newUserCache(10, 10, time.Minute, time.Minute)
+
+	// a lookup of user 1 reads the generation, then the user is changed before it caches the result
+	generation := cache.Generation("1")
+	cache.Remove("1")
+	if cache.AddLookedUp("1", 10, generation) {
+		t.Error("a lookup older than the invalidation was cached")
+	}
+	if rate := cache.GetRate("1"); rate != 0 {
+		t.Errorf("rate = %v, want 0", rate)
+	}
+
+	// the same for a lookup of a missing user id, created in the meantime
+	generation = cache.Generation("2")
+	cache.Add("2", 20)
+	if cache.AddUnknown("2", generation) {
+		t.Error("an unknown mark older than the invalidation was cached")
+	}
+	if cache.IsUnknown("2") || cache.GetRate("2") != 20 {
+		t.Error("the stale lookup replaced the added user")
+	}
+
+	// other users and later lookups are cached
+	if !cache.AddLookedUp("3", 30, cache.Generation("3")) {
+		t.Error("a lookup of another user wasn't cached")
+	}
+	if !cache.AddLookedUp("1", 10, cache.Generation("1")) {
+		t.Error("a lookup after the invalidation wasn't cached")
+	}
+
+	// the sweep forgets the invalidations, but not the lookups started before it
+	generation = cache.Generation("4")
+	cache.Remove("4")
+	cache.sweep()
+	if len(cache.invalidated) != 0 {
+		t.Errorf("%d invalidations kept after a sweep", len(cache.invalidated))
+	}
+	if cache.AddLookedUp("4", 40, generation) {
+		t.Error("a lookup older than an invalidation forgotten by the sweep was cached")
+	}
+	if !cache.AddLookedUp("4", 40, cache.Generation("4")) {
+		t.Error("a lookup after the sweep wasn't cached")
+	}
+}
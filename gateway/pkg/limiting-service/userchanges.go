@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// userChangesRetention is how long user changes are kept. It is longer than the default user cache TTL,
+	// so a gateway that couldn't poll for a while still sees the changes made meanwhile.
+	userChangesRetention     = time.Hour
+	userChangesPruneInterval = 10 * time.Minute
+
+	// userChangesLookback is how many ids before the last one seen are polled again.
+	// PostgreSQL ids are assigned before commit, so a change can be committed after a change with a greater id.
+	userChangesLookback = 100
+)
+
+// watchUserChanges polls the user changes made by any gateway, or by an import, until the context is done.
+// The changed users are dropped from the cache, so their next request reads them from the database.
+func (l *Limiter) watchUserChanges(ctx context.Context) {
+	last := l.lastUserChange
+	seen := map[int64]bool{}
+	lastPrune := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.config.Load().UserChangesPoll):
+		}
+
+		changes, err := l.store.UserChangesSince(ctx, max(0, last-userChangesLookback))
+		if err != nil {
+			l.logger.WriteError(fmt.Errorf("failed to poll user changes: %w", err))
+			continue
+		}
+
+		for _, c := range changes {
+			if seen[c.Id] {
+				continue
+			}
+			seen[c.Id] = true
+			last = max(last, c.Id)
+
+			l.userIdCache.Remove(c.UserId)
+			metrics.Add(metricUserCacheInvalidations, 1)
+		}
+		for id := range seen {
+			if id <= last-userChangesLookback {
+				delete(seen, id)
+			}
+		}
+
+		if time.Since(lastPrune) > userChangesPruneInterval {
+			lastPrune = time.Now()
+			if _, err := l.store.PruneUserChanges(ctx, lastPrune.Add(-userChangesRetention)); err != nil {
+				l.logger.WriteError(fmt.Errorf("failed to prune user changes: %w", err))
+			}
+		}
+	}
+}
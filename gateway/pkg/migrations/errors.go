@@ -0,0 +1,11 @@
+package migrations
+
+import "errors"
+
+var (
+	ErrInvalidVersion      = errors.New("invalid migration version")
+	ErrDuplicateVersion    = errors.New("duplicate migration version")
+	ErrIncompleteMigration = errors.New("migration needs both an up and a down file")
+	ErrUnknownVersion      = errors.New("unknown migration version")
+	ErrSchemaBehind        = errors.New("database schema is not up to date, run the db-migration up command")
+)
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"gateway/pkg/storage"
+)
+
+// legacyUpgrades bring the tables created before the versioned migrations up to date.
+// They run before the up script of the migration with the same version, in its transaction,
+// and must do nothing on a database created by the migrations.
+var legacyUpgrades = map[string]map[int]func(ctx context.Context, tx *sql.Tx) error{
+	storage.SQLite: {
+		2: addUsersSuspended,
+	},
+}
+
+// addUsersSuspended adds the suspended column to a users table created by the first releases, which had no migrations.
+// 0001_create_users keeps an existing users table, so the column is added before 0002_seed_users, the first
+// migration using it. This also repairs databases where 0001 was applied to such a table.
+func addUsersSuspended(ctx context.Context, tx *sql.Tx) error {
+	var found bool
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) > 0 FROM pragma_table_info('users') WHERE name = 'suspended'`).Scan(&found)
+	if err != nil || found {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT 0`)
+	return err
+}
@@ -0,0 +1,326 @@
+// Package migrations applies the versioned database migrations of the gateway.
+//
+// Migrations are embedded SQL files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, in one directory per storage backend.
+// The applied versions are recorded in the schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"gateway/pkg/storage"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+// schemaTable creates the table recording the applied migrations, per storage backend.
+var schemaTable = map[string]string{
+	storage.SQLite: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`,
+	storage.Postgres: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`,
+}
+
+// noTransaction starts the migration scripts that can't run in a transaction, like a SQLite VACUUM.
+const noTransaction = "-- migrate: no transaction"
+
+// fileName matches the migration file names, e.g. 0001_create_users.up.sql
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change, with the SQL to apply and to revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes a migration and when it was applied.
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"` // nil if the migration is pending
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	store      *storage.Store
+	migrations []Migration // sorted by version
+}
+
+// New returns a Migrator for the embedded migrations of the store backend.
+func New(store *storage.Store) (*Migrator, error) {
+	sub, err := fs.Sub(files, store.Dialect())
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{store: store, migrations: migrations}, nil
+}
+
+// Load reads the migrations from the root of fsys.
+// Every version must have both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidVersion, entry.Name())
+		}
+
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, found := byVersion[version]
+		if !found {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateVersion, version)
+		}
+
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: %04d_%s", ErrIncompleteMigration, m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the version of the last known migration.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Current returns the version of the last applied migration, or 0 if none was applied.
+func (m *Migrator) Current(ctx context.Context) (int, error) {
+	if err := m.createTable(ctx); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := m.store.DB().QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Status lists every known migration, and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+
+	rows, err := m.store.DB().QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		s := Status{Version: migration.Version, Name: migration.Name}
+		if appliedAt, found := applied[migration.Version]; found {
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down reverts the last applied migration.
+func (m *Migrator) Down(ctx context.Context) ([]Migration, error) {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return nil, nil
+	}
+
+	previous := 0
+	for _, migration := range m.migrations {
+		if migration.Version < current {
+			previous = migration.Version
+		}
+	}
+	return m.Goto(ctx, previous)
+}
+
+// Goto applies or reverts migrations until the schema is at the given version.
+// Version 0 reverts every migration. Each migration runs in its own transaction,
+// so on failure the schema stays at the last migration that succeeded.
+// It returns the migrations that were applied or reverted, in order.
+func (m *Migrator) Goto(ctx context.Context, version int) ([]Migration, error) {
+	if version != 0 && !m.known(version) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	current, err := m.Current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current != 0 && !m.known(current) {
+		return nil, fmt.Errorf("%w: the database is at version %d", ErrUnknownVersion, current)
+	}
+
+	var done []Migration
+
+	if version >= current {
+		for _, migration := range m.migrations {
+			if migration.Version <= current || migration.Version > version {
+				continue
+			}
+			if err := m.apply(ctx, migration, true); err != nil {
+				return done, err
+			}
+			done = append(done, migration)
+		}
+		return done, nil
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version > current || migration.Version <= version {
+			continue
+		}
+		if err := m.apply(ctx, migration, false); err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Check returns ErrSchemaBehind if there are pending migrations.
+func (m *Migrator) Check(ctx context.Context) error {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current < m.Latest() {
+		return fmt.Errorf("%w: the database is at version %d, expected %d", ErrSchemaBehind, current, m.Latest())
+	}
+	return nil
+}
+
+// apply runs the up or down SQL of a migration and records it, in one transaction.
+// Scripts starting with noTransaction run on their own first, and the migration is only recorded if they succeed.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	script, record, args := migration.Down, m.store.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), []any{migration.Version}
+	if up {
+		script = migration.Up
+		record = m.store.Rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`)
+		args = append(args, migration.Name, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	if strings.HasPrefix(script, noTransaction) {
+		if _, err := m.store.DB().ExecContext(ctx, script); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		script = ""
+	}
+
+	tx, err := m.store.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if upgrade := legacyUpgrades[m.store.Dialect()][migration.Version]; up && upgrade != nil {
+		if err := upgrade(ctx, tx); err != nil {
+			return fmt.Errorf("migration %04d_%s: legacy upgrade: %w", migration.Version, migration.Name, err)
+		}
+	}
+	if script != "" {
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) createTable(ctx context.Context) error {
+	_, err := m.store.DB().ExecContext(ctx, schemaTable[m.store.Dialect()])
+	return err
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,5 @@
+INSERT INTO users (id, name, quota, suspended, created_at) VALUES
+    (0, 'Admin', 10, FALSE, now()),
+    (1, 'Ionel', 0.5, FALSE, now()),
+    (2, 'Ionela', 1.0, FALSE, now())
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS request_count (
+    user_id BIGINT NOT NULL,
+    path TEXT NOT NULL,
+    window_start BIGINT NOT NULL,
+    count INTEGER NOT NULL,
+    PRIMARY KEY (user_id, path, window_start)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN plan;
+
+DROP TABLE IF EXISTS plans;
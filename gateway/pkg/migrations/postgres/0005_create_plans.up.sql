@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS plans (
+    name TEXT PRIMARY KEY,
+    quota DOUBLE PRECISION NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN plan TEXT NOT NULL DEFAULT '';
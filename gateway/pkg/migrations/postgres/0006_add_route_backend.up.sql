@@ -0,0 +1,4 @@
+-- Backend keeping the limiting state of a route: memory, sql or redis
+ALTER TABLE routes ADD COLUMN backend TEXT NOT NULL DEFAULT '';
+
+UPDATE routes SET backend = CASE strategy WHEN 'fixed_window' THEN 'sql' ELSE 'memory' END WHERE NOT deleted;
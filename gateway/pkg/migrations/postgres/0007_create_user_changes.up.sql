@@ -0,0 +1,6 @@
+-- Users changed through the admin API or an import, polled by the gateways to invalidate their caches
+CREATE TABLE IF NOT EXISTS user_changes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL
+);
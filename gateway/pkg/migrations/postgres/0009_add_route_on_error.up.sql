@@ -0,0 +1,2 @@
+-- Policy of a route when its limiting backend fails: deny or allow
+ALTER TABLE routes ADD COLUMN on_error TEXT NOT NULL DEFAULT 'deny';
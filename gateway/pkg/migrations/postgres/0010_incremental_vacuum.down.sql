@@ -0,0 +1,2 @@
+-- PostgreSQL reuses the space of deleted rows through autovacuum, nothing to change.
+SELECT 1;
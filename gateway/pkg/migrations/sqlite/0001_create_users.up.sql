@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    quota FLOAT NOT NULL,
+    suspended BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL
+);
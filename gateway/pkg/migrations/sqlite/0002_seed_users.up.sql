@@ -0,0 +1,4 @@
+INSERT OR IGNORE INTO users (id, name, quota, suspended, created_at) VALUES
+    (0, 'Admin', 10, 0, strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
+    (1, 'Ionel', 0.5, 0, strftime('%Y-%m-%dT%H:%M:%SZ', 'now')),
+    (2, 'Ionela', 1.0, 0, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'));
@@ -0,0 +1,10 @@
+-- Routes created, updated or deleted through the admin API
+CREATE TABLE IF NOT EXISTS routes (
+    path TEXT PRIMARY KEY,
+    strategy TEXT NOT NULL,
+    capacity INTEGER NOT NULL DEFAULT 0,
+    window_size INTEGER NOT NULL DEFAULT 0,
+    sql_table TEXT NOT NULL DEFAULT '',
+    deleted BOOLEAN NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL
+);
@@ -0,0 +1,6 @@
+-- Users changed through the admin API or an import, polled by the gateways to invalidate their caches
+CREATE TABLE IF NOT EXISTS user_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    changed_at DATETIME NOT NULL
+);
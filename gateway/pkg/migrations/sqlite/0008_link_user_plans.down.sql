@@ -0,0 +1,2 @@
+UPDATE users SET quota = (SELECT plans.quota FROM plans WHERE plans.name = users.plan)
+WHERE plan <> '' AND quota = 0 AND EXISTS (SELECT 1 FROM plans WHERE plans.name = users.plan);
@@ -0,0 +1,3 @@
+-- users with the quota of their plan follow it, instead of keeping a copy
+UPDATE users SET quota = 0
+WHERE plan <> '' AND quota = (SELECT plans.quota FROM plans WHERE plans.name = users.plan);
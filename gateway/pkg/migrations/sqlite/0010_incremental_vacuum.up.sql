@@ -0,0 +1,5 @@
+-- migrate: no transaction
+-- Let the window janitor return the pages freed by deleted counts to the file system, see Store.ReclaimSpace.
+-- The mode of an existing database only changes with a VACUUM, which can't run in a transaction.
+PRAGMA auto_vacuum = INCREMENTAL;
+VACUUM;
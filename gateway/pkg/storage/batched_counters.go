@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// adder adds a number of requests to the count of a window, and returns the new count.
+type adder interface {
+	add(ctx context.Context, userId string, path string, windowStart int64, n int) (int, error)
+}
+
+// batchedCounters counts the requests in memory and writes them to the table in batches.
+//
+// For each window, it keeps the count read from the table at the last write, and the requests counted since.
+// The requests of a window are written every flush interval, see Store.FlushCounters, and as soon as
+// batchSize requests are waiting, so a gateway never accepts more than batchSize requests without
+// reading the count of the other gateways. With N gateways sharing the table, a window counts at most
+// max + (N-1) × batchSize requests. With a single gateway, it never counts past max.
+//
+// Reset and DeleteBefore change the table under every window, so they hold tableMu exclusively,
+// and the other calls hold it shared while they use a window: no request waiting to be written
+// can bring back a count they deleted.
+type batchedCounters struct {
+	base      Counters
+	adder     adder
+	batchSize int
+
+	tableMu       sync.RWMutex
+	deletedBefore int64 // windows that started before were deleted, their requests are no longer written
+
+	mu      sync.Mutex
+	windows map[windowKey]*batchedWindow
+}
+
+type windowKey struct {
+	userId      string
+	path        string
+	windowStart int64
+}
+
+type batchedWindow struct {
+	mu      sync.Mutex // held while the window is read or written to the table
+	loaded  bool
+	synced  int  // count in the table as of the last read or write
+	pending int  // requests counted since, not written yet
+	used    bool // counted a request since the last flush
+	removed bool // dropped from memory, a new window must be created
+}
+
+func newBatchedCounters(base Counters, batchSize int) *batchedCounters {
+	return &batchedCounters{
+		base:      base,
+		adder:     base.(adder),
+		batchSize: batchSize,
+		windows:   map[windowKey]*batchedWindow{},
+	}
+}
+
+// Increment counts a request in memory, unless the count of the window, as of the last write
+// plus the requests waiting to be written, already reached max.
+func (c *batchedCounters) Increment(ctx context.Context, userId string, path string, windowStart int64, max int) (bool, error) {
+	c.tableMu.RLock()
+	defer c.tableMu.RUnlock()
+
+	w := c.lockWindow(windowKey{userId: userId, path: path, windowStart: windowStart})
+	defer w.mu.Unlock()
+
+	if !w.loaded {
+		count, err := c.base.Count(ctx, userId, path, windowStart)
+		if err != nil {
+			return false, err
+		}
+		w.synced, w.loaded = count, true
+	}
+
+	if w.pending >= c.batchSize {
+		if err := c.write(ctx, windowKey{userId: userId, path: path, windowStart: windowStart}, w); err != nil {
+			return false, err
+		}
+	}
+
+	if w.synced+w.pending >= max {
+		return false, nil
+	}
+	w.pending++
+	w.used = true
+	return true, nil
+}
+
+// Count returns the count of a window in the table, plus the requests waiting to be written.
+func (c *batchedCounters) Count(ctx context.Context, userId string, path string, windowStart int64) (int, error) {
+	c.tableMu.RLock()
+	defer c.tableMu.RUnlock()
+
+	count, err := c.base.Count(ctx, userId, path, windowStart)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	w, found := c.windows[windowKey{userId: userId, path: path, windowStart: windowStart}]
+	c.mu.Unlock()
+	if !found {
+		return count, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return count + w.pending, nil
+}
+
+// Reset drops the requests waiting to be written for a user and path, then deletes their counts.
+func (c *batchedCounters) Reset(ctx context.Context, userId string, path string) error {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	c.drop(func(key windowKey) bool { return key.userId == userId && key.path == path })
+	return c.base.Reset(ctx, userId, path)
+}
+
+// TopUp writes the requests waiting for a window, lowers its count, and reads it again.
+func (c *batchedCounters) TopUp(ctx context.Context, userId string, path string, windowStart int64, amount int) error {
+	c.tableMu.RLock()
+	defer c.tableMu.RUnlock()
+
+	key := windowKey{userId: userId, path: path, windowStart: windowStart}
+	w := c.lockWindow(key)
+	defer w.mu.Unlock()
+
+	if err := c.write(ctx, key, w); err != nil {
+		return err
+	}
+	if err := c.base.TopUp(ctx, userId, path, windowStart, amount); err != nil {
+		return err
+	}
+
+	count, err := c.base.Count(ctx, userId, path, windowStart)
+	if err != nil {
+		return err
+	}
+	w.synced, w.loaded = count, true
+	return nil
+}
+
+// DeleteBefore drops the windows that started before a time, with their requests waiting to be written,
+// then deletes them from the table. Requests counted in them afterwards are never written.
+func (c *batchedCounters) DeleteBefore(ctx context.Context, windowStart int64) (int64, error) {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	c.deletedBefore = max(c.deletedBefore, windowStart)
+	c.drop(func(key windowKey) bool { return key.windowStart < windowStart })
+	return c.base.DeleteBefore(ctx, windowStart)
+}
+
+// drop removes the windows matching a key from memory, with their requests waiting to be written.
+// The caller must hold tableMu exclusively, so no window is in use.
+func (c *batchedCounters) drop(match func(windowKey) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, w := range c.windows {
+		if match(key) {
+			delete(c.windows, key)
+			w.removed = true
+		}
+	}
+}
+
+// flush writes the requests waiting for every window, and reads the count of the other windows again.
+// Windows that didn't count any request since the previous flush are dropped from memory.
+// Every window is tried, the errors are joined.
+func (c *batchedCounters) flush(ctx context.Context) error {
+	c.mu.Lock()
+	keys := make([]windowKey, 0, len(c.windows))
+	for key := range c.windows {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, key := range keys {
+		c.tableMu.RLock()
+		c.mu.Lock()
+		w, found := c.windows[key]
+		c.mu.Unlock()
+		if !found {
+			c.tableMu.RUnlock()
+			continue
+		}
+
+		w.mu.Lock()
+		if w.removed {
+			w.mu.Unlock()
+			c.tableMu.RUnlock()
+			continue
+		}
+		if err := c.write(ctx, key, w); err != nil {
+			errs = append(errs, fmt.Errorf("window %d of user %s for %s: %w", key.windowStart, key.userId, key.path, err))
+		} else if !w.used {
+			c.mu.Lock()
+			delete(c.windows, key)
+			c.mu.Unlock()
+			w.removed = true
+		}
+		w.used = false
+		w.mu.Unlock()
+		c.tableMu.RUnlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// write adds the requests waiting for a window to the table, and keeps the new count.
+// Without waiting requests, or if the window was deleted, the count is only read.
+// The caller must hold tableMu shared and the lock of the window.
+func (c *batchedCounters) write(ctx context.Context, key windowKey, w *batchedWindow) error {
+	var count int
+	var err error
+	if w.pending > 0 && key.windowStart >= c.deletedBefore {
+		count, err = c.adder.add(ctx, key.userId, key.path, key.windowStart, w.pending)
+	} else {
+		count, err = c.base.Count(ctx, key.userId, key.path, key.windowStart)
+	}
+	if err != nil {
+		return err
+	}
+	w.synced, w.pending, w.loaded = count, 0, true
+	return nil
+}
+
+// lockWindow returns the state of a window, created if needed, with its lock held.
+func (c *batchedCounters) lockWindow(key windowKey) *batchedWindow {
+	for {
+		c.mu.Lock()
+		w, found := c.windows[key]
+		if !found {
+			w = &batchedWindow{}
+			c.windows[key] = w
+		}
+		c.mu.Unlock()
+
+		w.mu.Lock()
+		if !w.removed {
+			return w
+		}
+		// dropped by a flush or a reset meanwhile
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,308 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+)
+
+// openBatchedStore returns a migrated SQLite store that writes the fixed window counts in batches of batchSize.
+func openBatchedStore(t *testing.T, batchSize int) *storage.Store {
+	t.Helper()
+	return openStore(t, &config.Config{
+		Storage:             storage.SQLite,
+		DBFile:              filepath.Join(t.TempDir(), "limiter.db"),
+		WindowFlushInterval: time.Second,
+		WindowFlushBatch:    batchSize,
+	})
+}
+
+// tableCount returns the count of a window written to request_count, without the requests waiting in memory.
+func tableCount(t *testing.T, store *storage.Store, userId string, windowStart int64) int {
+	t.Helper()
+	var count int
+	err := store.DB().QueryRow(
+		"SELECT COALESCE(SUM(count), 0) FROM request_count WHERE user_id = ? AND path = '/foo' AND window_start = ?",
+		userId, windowStart,
+	).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBatchedCountersNeverPassMax(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 10)
+	counters := store.Counters("request_count")
+
+	// 200 requests for 25 allowed, some writing their batch while others are counted
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				ok, err := counters.Increment(ctx, "1", "/foo", 0, 25)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := accepted.Load(); got != 25 {
+		t.Errorf("accepted = %d, want 25", got)
+	}
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := tableCount(t, store, "1", 0); count != 25 {
+		t.Errorf("count = %d, want 25", count)
+	}
+}
+
+func TestBatchedCountersFlushWritesPending(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 10)
+	counters := store.Counters("request_count")
+
+	for user := range 3 {
+		for range 7 {
+			if _, err := counters.Increment(ctx, strconv.Itoa(user), "/foo", 0, 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if count := tableCount(t, store, "1", 0); count != 0 {
+		t.Fatalf("count before the flush = %d, want 0: fewer than a batch", count)
+	}
+
+	// as on shutdown
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for user := range 3 {
+		if count := tableCount(t, store, strconv.Itoa(user), 0); count != 7 {
+			t.Errorf("count of user %d = %d, want 7", user, count)
+		}
+	}
+}
+
+func TestBatchedCountersResetDropsPending(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 10)
+	counters := store.Counters("request_count")
+
+	// 12 requests: a batch of 10 written, 2 waiting
+	for range 12 {
+		if _, err := counters.Increment(ctx, "1", "/foo", 0, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := counters.Reset(ctx, "1", "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := tableCount(t, store, "1", 0); count != 0 {
+		t.Errorf("count after a reset = %d, want 0", count)
+	}
+
+	// counted again from 0
+	if ok, err := counters.Increment(ctx, "1", "/foo", 0, 1); err != nil || !ok {
+		t.Fatalf("after a reset: accepted = %v, err = %v, want accepted", ok, err)
+	}
+}
+
+func TestBatchedCountersTopUpWritesPending(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 10)
+	counters := store.Counters("request_count")
+
+	for range 5 {
+		if _, err := counters.Increment(ctx, "1", "/foo", 0, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := counters.TopUp(ctx, "1", "/foo", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if count := tableCount(t, store, "1", 0); count != 3 {
+		t.Errorf("count after the top-up = %d, want 3", count)
+	}
+	for i, want := range []bool{true, true, false} {
+		ok, err := counters.Increment(ctx, "1", "/foo", 0, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("request %d after the top-up: accepted = %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+func TestBatchedCountersResetAndTopUpRaceWithFlush(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 5)
+	counters := store.Counters("request_count")
+
+	stop := make(chan struct{})
+	var flushes sync.WaitGroup
+	flushes.Add(1)
+	go func() {
+		defer flushes.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := store.FlushCounters(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// user 1 is reset while counted, user 2 gives back every request it makes
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				if _, err := counters.Increment(ctx, "1", "/foo", 0, 1000); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%10 == 0 {
+					if err := counters.Reset(ctx, "1", "/foo"); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				if _, err := counters.Increment(ctx, "2", "/foo", 0, 1000); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := counters.TopUp(ctx, "2", "/foo", 0, 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := counters.Reset(ctx, "1", "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	flushes.Wait()
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := tableCount(t, store, "1", 0); count != 0 {
+		t.Errorf("count of user 1 after the last reset = %d, want 0", count)
+	}
+	if count := tableCount(t, store, "2", 0); count != 0 {
+		t.Errorf("count of user 2 = %d, want 0: every request was given back", count)
+	}
+}
+
+func TestBatchedCountersDeleteBeforeIsFinal(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 10)
+	counters := store.Counters("request_count")
+
+	// waiting to be written when the janitor runs
+	for range 3 {
+		if _, err := counters.Increment(ctx, "1", "/foo", 100, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := counters.DeleteBefore(ctx, 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := tableCount(t, store, "1", 100); count != 0 {
+		t.Errorf("count of the deleted window = %d, want 0", count)
+	}
+}
+
+func TestBatchedCountersDeleteBeforeRacesWithFlush(t *testing.T) {
+	ctx := context.Background()
+	store := openBatchedStore(t, 5)
+	counters := store.Counters("request_count")
+
+	var deleted atomic.Bool
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if _, err := counters.Increment(ctx, "1", "/foo", 100, 1000); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for !deleted.Load() {
+			if err := store.FlushCounters(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		// writes after the janitor must not bring the window back
+		for range 10 {
+			if err := store.FlushCounters(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		if _, err := counters.DeleteBefore(ctx, 200); err != nil {
+			t.Error(err)
+		}
+		deleted.Store(true)
+	}()
+	wg.Wait()
+
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := tableCount(t, store, "1", 100); count != 0 {
+		t.Errorf("count of the deleted window = %d, want 0", count)
+	}
+}
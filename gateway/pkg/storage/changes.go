@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// UserChange is a row of the user_changes table, written whenever a user is created, updated or deleted.
+// The gateways poll the table to drop the changed users from their caches.
+type UserChange struct {
+	Id     int64
+	UserId string
+}
+
+// LogUserChange records that a user changed, in the transaction of the change.
+func (s *Store) LogUserChange(ctx context.Context, tx *sql.Tx, userId string) error {
+	_, err := tx.ExecContext(ctx, s.Rebind(`
+	INSERT INTO user_changes (user_id, changed_at) VALUES (?, ?)`),
+		userId, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+// LastUserChange returns the id of the last user change, or 0 if there is none.
+func (s *Store) LastUserChange(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM user_changes`).Scan(&id)
+	return id, err
+}
+
+// UserChangesSince returns the user changes with an id greater than the given one, ordered by id.
+func (s *Store) UserChangesSince(ctx context.Context, id int64) ([]UserChange, error) {
+	rows, err := s.db.QueryContext(ctx, s.Rebind(`
+	SELECT id, user_id FROM user_changes WHERE id > ? ORDER BY id`),
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []UserChange{}
+	for rows.Next() {
+		var c UserChange
+		var userId int64
+		if err := rows.Scan(&c.Id, &userId); err != nil {
+			return nil, err
+		}
+		c.UserId = strconv.FormatInt(userId, 10)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// PruneUserChanges deletes the user changes older than the given time, and returns how many were deleted.
+func (s *Store) PruneUserChanges(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.Rebind(`
+	DELETE FROM user_changes WHERE changed_at < ?`),
+		before.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds.
+func (s *Store) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
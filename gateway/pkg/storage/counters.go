@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Counters stores the request counts of the fixed window strategy, per user, path and window.
+type Counters interface {
+	// Increment counts a request in a window, unless the window count already reached max.
+	// It reports whether the request was counted.
+	Increment(ctx context.Context, userId string, path string, windowStart int64, max int) (bool, error)
+
+	// Count returns the request count of a window.
+	Count(ctx context.Context, userId string, path string, windowStart int64) (int, error)
+
+	// Reset deletes the request counts of a user for a path, in every window.
+	Reset(ctx context.Context, userId string, path string) error
+
+	// TopUp lowers the request count of a window, down to 0.
+	TopUp(ctx context.Context, userId string, path string, windowStart int64, amount int) error
+
+	// DeleteBefore deletes the windows that started before a time, in Unix seconds, and returns how many were deleted.
+	DeleteBefore(ctx context.Context, windowStart int64) (int64, error)
+}
+
+// Counters returns the counters stored in a table.
+// With write-behind batching, every call for a table returns the same counters, which write the
+// counts to the table in batches, see FlushCounters.
+// The table name must already be validated.
+func (s *Store) Counters(table string) Counters {
+	if s.batchers == nil {
+		return s.tableCounters(table)
+	}
+
+	s.batchersMu.Lock()
+	defer s.batchersMu.Unlock()
+
+	c, found := s.batchers[table]
+	if !found {
+		c = newBatchedCounters(s.tableCounters(table), s.windowBatch)
+		s.batchers[table] = c
+	}
+	return c
+}
+
+// FlushCounters writes the fixed window counts waiting in memory to their tables.
+// It must be called every flush interval, and before closing the store so no count is lost.
+// It does nothing without write-behind batching.
+func (s *Store) FlushCounters(ctx context.Context) error {
+	s.batchersMu.Lock()
+	batchers := make(map[string]*batchedCounters, len(s.batchers))
+	for table, c := range s.batchers {
+		batchers[table] = c
+	}
+	s.batchersMu.Unlock()
+
+	var errs []error
+	for table, c := range batchers {
+		if err := c.flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", table, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tableCounters returns counters that read and write the table on every call.
+func (s *Store) tableCounters(table string) Counters {
+	if s.dialect == Postgres {
+		return &postgresCounters{db: s.db, table: table}
+	}
+	return &sqliteCounters{db: s.db, table: table}
+}
+
+// sqliteCounters increments the count of a window with a single upsert, like postgresCounters.
+type sqliteCounters struct {
+	db    *sql.DB
+	table string
+}
+
+// Increment creates the window with a count of 1, or increments its count if it is below max.
+// The upsert returns no row when the window is full.
+func (c *sqliteCounters) Increment(ctx context.Context, userId string, path string, windowStart int64, max int) (bool, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		INSERT INTO `+c.table+` (user_id, path, window_start, count)
+		VALUES (?, ?, ?, 1)
+		ON CONFLICT (user_id, path, window_start) DO UPDATE
+		SET count = count + 1
+		WHERE count < ?
+		RETURNING count`,
+		userId, path, windowStart, max,
+	).Scan(&count)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sql upsert failed: %w", err)
+	}
+	return true, nil
+}
+
+func (c *sqliteCounters) Count(ctx context.Context, userId string, path string, windowStart int64) (int, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		SELECT count FROM `+c.table+`
+		WHERE user_id = ? AND path = ? AND window_start = ?`,
+		userId, path, windowStart,
+	).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (c *sqliteCounters) Reset(ctx context.Context, userId string, path string) error {
+	_, err := c.db.ExecContext(ctx, `
+		DELETE FROM `+c.table+`
+		WHERE user_id = ? AND path = ?`,
+		userId, path,
+	)
+	return err
+}
+
+func (c *sqliteCounters) TopUp(ctx context.Context, userId string, path string, windowStart int64, amount int) error {
+	_, err := c.db.ExecContext(ctx, `
+		UPDATE `+c.table+`
+		SET count = MAX(count - ?, 0)
+		WHERE user_id = ? AND path = ? AND window_start = ?`,
+		amount, userId, path, windowStart,
+	)
+	return err
+}
+
+// add adds n requests to the count of a window, created if needed, and returns the new count.
+func (c *sqliteCounters) add(ctx context.Context, userId string, path string, windowStart int64, n int) (int, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		INSERT INTO `+c.table+` (user_id, path, window_start, count)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, path, window_start) DO UPDATE
+		SET count = count + excluded.count
+		RETURNING count`,
+		userId, path, windowStart, n,
+	).Scan(&count)
+	return count, err
+}
+
+func (c *sqliteCounters) DeleteBefore(ctx context.Context, windowStart int64) (int64, error) {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM "+c.table+" WHERE window_start < ?", windowStart)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// postgresCounters increments the count of a window with a single upsert,
+// so concurrent gateways never count past the limit.
+type postgresCounters struct {
+	db    *sql.DB
+	table string
+}
+
+// Increment creates the window with a count of 1, or increments its count if it is below max.
+// The upsert returns no row when the window is full.
+func (c *postgresCounters) Increment(ctx context.Context, userId string, path string, windowStart int64, max int) (bool, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		INSERT INTO `+c.table+` AS t (user_id, path, window_start, count)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (user_id, path, window_start) DO UPDATE
+		SET count = t.count + 1
+		WHERE t.count < $4
+		RETURNING t.count`,
+		userId, path, windowStart, max,
+	).Scan(&count)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sql upsert failed: %w", err)
+	}
+	return true, nil
+}
+
+func (c *postgresCounters) Count(ctx context.Context, userId string, path string, windowStart int64) (int, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		SELECT count FROM `+c.table+`
+		WHERE user_id = $1 AND path = $2 AND window_start = $3`,
+		userId, path, windowStart,
+	).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (c *postgresCounters) Reset(ctx context.Context, userId string, path string) error {
+	_, err := c.db.ExecContext(ctx, `
+		DELETE FROM `+c.table+`
+		WHERE user_id = $1 AND path = $2`,
+		userId, path,
+	)
+	return err
+}
+
+func (c *postgresCounters) TopUp(ctx context.Context, userId string, path string, windowStart int64, amount int) error {
+	_, err := c.db.ExecContext(ctx, `
+		UPDATE `+c.table+`
+		SET count = GREATEST(count - $1, 0)
+		WHERE user_id = $2 AND path = $3 AND window_start = $4`,
+		amount, userId, path, windowStart,
+	)
+	return err
+}
+
+// add adds n requests to the count of a window, created if needed, and returns the new count.
+func (c *postgresCounters) add(ctx context.Context, userId string, path string, windowStart int64, n int) (int, error) {
+	var count int
+	err := c.db.QueryRowContext(ctx, `
+		INSERT INTO `+c.table+` AS t (user_id, path, window_start, count)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, path, window_start) DO UPDATE
+		SET count = t.count + excluded.count
+		RETURNING t.count`,
+		userId, path, windowStart, n,
+	).Scan(&count)
+	return count, err
+}
+
+func (c *postgresCounters) DeleteBefore(ctx context.Context, windowStart int64) (int64, error) {
+	res, err := c.db.ExecContext(ctx, "DELETE FROM "+c.table+" WHERE window_start < $1", windowStart)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
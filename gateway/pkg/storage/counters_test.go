@@ -0,0 +1,309 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+)
+
+// transactionIncrement counts a request the way the SQLite counters did before the upsert:
+// a transaction reads the count of the window, then updates or inserts it.
+func transactionIncrement(ctx context.Context, db *sql.DB, userId string, path string, windowStart int64, max int) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, `
+		SELECT count FROM request_count
+		WHERE user_id = ? AND path = ? AND window_start = ?`,
+		userId, path, windowStart,
+	).Scan(&count)
+
+	switch {
+	case err == nil:
+		if count >= max {
+			return false, nil
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE request_count SET count = count + 1
+			WHERE user_id = ? AND path = ? AND window_start = ?`,
+			userId, path, windowStart,
+		)
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO request_count (user_id, path, window_start, count)
+			VALUES (?, ?, ?, 1)`,
+			userId, path, windowStart,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// openCountTable opens a SQLite database with only the request_count table, with the given connection string.
+func openCountTable(b *testing.B, dsn string) *sql.DB {
+	b.Helper()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE request_count (
+			user_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			window_start INTEGER NOT NULL,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (user_id, path, window_start)
+		)`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func isBusy(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "SQLITE_BUSY") || strings.Contains(err.Error(), "database is locked"))
+}
+
+// BenchmarkSQLiteIncrement counts requests of a few users from many goroutines, and reports the requests
+// that failed with SQLITE_BUSY as busy/op, and with other errors as failed/op: the read then write transaction
+// fails when another connection writes between its read and its write, even with a busy timeout,
+// and a commit that fails with SQLITE_BUSY leaves its connection in the transaction, so the next ones on it fail.
+// The upsert waits for the lock, and must not fail.
+// Requests that fail return early, so the time per request of the transactions is lower than if they succeeded.
+func BenchmarkSQLiteIncrement(b *testing.B) {
+	increments := []struct {
+		name        string
+		increment   func(b *testing.B) func(ctx context.Context, userId string) (bool, error)
+		mustSucceed bool // any failed request fails the benchmark
+	}{
+		{
+			name: "transaction",
+			increment: func(b *testing.B) func(context.Context, string) (bool, error) {
+				db := openCountTable(b, "file:"+filepath.Join(b.TempDir(), "limiter.db"))
+				return func(ctx context.Context, userId string) (bool, error) {
+					return transactionIncrement(ctx, db, userId, "/foo", 0, 1<<30)
+				}
+			},
+		},
+		{
+			name: "transaction_wal",
+			increment: func(b *testing.B) func(context.Context, string) (bool, error) {
+				db := openCountTable(b, "file:"+filepath.Join(b.TempDir(), "limiter.db")+
+					"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+				return func(ctx context.Context, userId string) (bool, error) {
+					return transactionIncrement(ctx, db, userId, "/foo", 0, 1<<30)
+				}
+			},
+		},
+		{
+			name: "upsert_wal",
+			increment: func(b *testing.B) func(context.Context, string) (bool, error) {
+				store := openStore(b, &config.Config{
+					Storage: storage.SQLite,
+					DBFile:  filepath.Join(b.TempDir(), "limiter.db"),
+				})
+				counters := store.Counters("request_count")
+				return func(ctx context.Context, userId string) (bool, error) {
+					return counters.Increment(ctx, userId, "/foo", 0, 1<<30)
+				}
+			},
+			mustSucceed: true,
+		},
+	}
+
+	for _, inc := range increments {
+		b.Run(inc.name, func(b *testing.B) {
+			increment := inc.increment(b)
+			ctx := context.Background()
+
+			var next, busy, failed atomic.Int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					userId := strconv.Itoa(int(next.Add(1) % 10))
+					_, err := increment(ctx, userId)
+					switch {
+					case isBusy(err):
+						busy.Add(1)
+					case err != nil:
+						failed.Add(1)
+					}
+				}
+			})
+			b.StopTimer()
+
+			b.ReportMetric(float64(busy.Load())/float64(b.N), "busy/op")
+			b.ReportMetric(float64(failed.Load())/float64(b.N), "failed/op")
+			if inc.mustSucceed && busy.Load()+failed.Load() > 0 {
+				b.Errorf("%d requests failed with SQLITE_BUSY, %d with other errors", busy.Load(), failed.Load())
+			}
+		})
+	}
+}
+
+// openCounterStores returns the stores of openStores, writing the counts directly,
+// and the same stores writing them in batches, suffixed with _batched.
+func openCounterStores(t *testing.T) map[string]*storage.Store {
+	t.Helper()
+	stores := openStores(t)
+	batched := openConfiguredStores(t, config.Config{WindowFlushInterval: time.Second, WindowFlushBatch: 10})
+	for dialect, store := range batched {
+		stores[dialect+"_batched"] = store
+	}
+	return stores
+}
+
+// windowCount returns the count of a window once the counts waiting in memory are written.
+func windowCount(t *testing.T, store *storage.Store, counters storage.Counters, userId string, windowStart int64) int {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.FlushCounters(ctx); err != nil {
+		t.Fatal(err)
+	}
+	count, err := counters.Count(ctx, userId, "/foo", windowStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestCountersIncrementStopsAtMax(t *testing.T) {
+	for name, store := range openCounterStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counters := store.Counters("request_count")
+
+			// 200 concurrent requests for 25 allowed, the first ones creating the window
+			var accepted atomic.Int32
+			var wg sync.WaitGroup
+			for range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 10 {
+						ok, err := counters.Increment(ctx, "1", "/foo", 60, 25)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if ok {
+							accepted.Add(1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := accepted.Load(); got != 25 {
+				t.Errorf("accepted = %d, want 25", got)
+			}
+			if count := windowCount(t, store, counters, "1", 60); count != 25 {
+				t.Errorf("count = %d, want 25", count)
+			}
+			if count := windowCount(t, store, counters, "1", 120); count != 0 {
+				t.Errorf("count of an unused window = %d, want 0", count)
+			}
+		})
+	}
+}
+
+func TestCountersResetAndTopUp(t *testing.T) {
+	for name, store := range openCounterStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counters := store.Counters("request_count")
+
+			increment := func(userId string, windowStart int64, n int) {
+				t.Helper()
+				for range n {
+					if ok, err := counters.Increment(ctx, userId, "/foo", windowStart, 100); err != nil || !ok {
+						t.Fatalf("Increment = %v, %v", ok, err)
+					}
+				}
+			}
+			increment("1", 0, 5)
+			increment("1", 60, 3)
+			increment("2", 0, 2)
+
+			if err := counters.TopUp(ctx, "1", "/foo", 0, 2); err != nil {
+				t.Fatal(err)
+			}
+			if count := windowCount(t, store, counters, "1", 0); count != 3 {
+				t.Errorf("count after a top-up of 2 = %d, want 3", count)
+			}
+			if err := counters.TopUp(ctx, "1", "/foo", 0, 10); err != nil {
+				t.Fatal(err)
+			}
+			if count := windowCount(t, store, counters, "1", 0); count != 0 {
+				t.Errorf("count after a top-up past 0 = %d, want 0", count)
+			}
+
+			if err := counters.Reset(ctx, "1", "/foo"); err != nil {
+				t.Fatal(err)
+			}
+			if count := windowCount(t, store, counters, "1", 60); count != 0 {
+				t.Errorf("count after a reset = %d, want 0", count)
+			}
+			if count := windowCount(t, store, counters, "2", 0); count != 2 {
+				t.Errorf("count of another user after a reset = %d, want 2", count)
+			}
+
+			// the window starts over after a reset
+			increment("1", 60, 1)
+			if count := windowCount(t, store, counters, "1", 60); count != 1 {
+				t.Errorf("count after a reset and a request = %d, want 1", count)
+			}
+		})
+	}
+}
+
+func TestCountersDeleteBefore(t *testing.T) {
+	for name, store := range openCounterStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counters := store.Counters("request_count")
+
+			for _, windowStart := range []int64{0, 60, 120} {
+				if _, err := counters.Increment(ctx, "1", "/foo", windowStart, 10); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.FlushCounters(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, err := counters.DeleteBefore(ctx, 120)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != 2 {
+				t.Errorf("deleted = %d, want 2", deleted)
+			}
+			for windowStart, want := range map[int64]int{0: 0, 60: 0, 120: 1} {
+				if count := windowCount(t, store, counters, "1", windowStart); count != want {
+					t.Errorf("count of window %d = %d, want %d", windowStart, count, want)
+				}
+			}
+		})
+	}
+}
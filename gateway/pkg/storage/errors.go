@@ -0,0 +1,9 @@
+package storage
+
+import "errors"
+
+var (
+	ErrUnknownStorage = errors.New("unknown storage backend")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserExists     = errors.New("user already exists")
+)
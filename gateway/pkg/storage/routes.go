@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"gateway/pkg/config"
+	"time"
+)
+
+// RouteOverride is a route created, changed or deleted through the admin API.
+// Overrides take precedence over the routes of the configuration file.
+type RouteOverride struct {
+	Path    string
+	Config  config.RouteConfig
+	Deleted bool
+}
+
+// RouteOverrides returns every stored route override.
+func (s *Store) RouteOverrides(ctx context.Context) ([]RouteOverride, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT path, strategy, backend, capacity, window_size, sql_table, on_error, deleted FROM routes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []RouteOverride{}
+	for rows.Next() {
+		var o RouteOverride
+		err := rows.Scan(&o.Path, &o.Config.Strategy, &o.Config.Backend, &o.Config.BucketCap,
+			&o.Config.WindowLength, &o.Config.SqlTable, &o.Config.OnError, &o.Deleted)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+
+	return overrides, rows.Err()
+}
+
+// SaveRouteOverride creates or replaces the override of a route.
+func (s *Store) SaveRouteOverride(ctx context.Context, o RouteOverride) error {
+	_, err := s.db.ExecContext(ctx, s.Rebind(`
+	INSERT INTO routes (path, strategy, backend, capacity, window_size, sql_table, on_error, deleted, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (path) DO UPDATE SET
+		strategy = excluded.strategy,
+		backend = excluded.backend,
+		capacity = excluded.capacity,
+		window_size = excluded.window_size,
+		sql_table = excluded.sql_table,
+		on_error = excluded.on_error,
+		deleted = excluded.deleted,
+		updated_at = excluded.updated_at`),
+		o.Path, o.Config.Strategy, o.Config.Backend, o.Config.BucketCap, o.Config.WindowLength,
+		o.Config.SqlTable, o.Config.OnError, o.Deleted, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
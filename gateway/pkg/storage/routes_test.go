@@ -0,0 +1,49 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+)
+
+func TestRouteOverrideKeepsOnError(t *testing.T) {
+	for dialect, store := range openStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			ctx := context.Background()
+
+			want := config.RouteConfig{
+				Strategy:     "fixed_window",
+				Backend:      config.BackendSQL,
+				WindowLength: 60,
+				SqlTable:     "request_count",
+				OnError:      config.OnErrorAllow,
+			}
+			if err := store.SaveRouteOverride(ctx, storage.RouteOverride{Path: "/foo", Config: want}); err != nil {
+				t.Fatal(err)
+			}
+
+			overrides, err := store.RouteOverrides(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(overrides) != 1 || overrides[0].Path != "/foo" || overrides[0].Config != want {
+				t.Fatalf("overrides = %+v, want /foo with %+v", overrides, want)
+			}
+
+			// changing only the policy
+			want.OnError = config.OnErrorDeny
+			if err := store.SaveRouteOverride(ctx, storage.RouteOverride{Path: "/foo", Config: want}); err != nil {
+				t.Fatal(err)
+			}
+			overrides, err = store.RouteOverrides(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := overrides[0].Config.OnError; got != config.OnErrorDeny {
+				t.Errorf("on_error = %q, want %q", got, config.OnErrorDeny)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"gateway/pkg/config"
+	"gateway/pkg/storage"
+)
+
+func TestReclaimSpaceShrinksSQLite(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t, &config.Config{
+		Storage: storage.SQLite,
+		DBFile:  filepath.Join(t.TempDir(), "limiter.db"),
+	})
+	db := store.DB()
+
+	pageCount := func() int64 {
+		t.Helper()
+		var pages int64
+		if err := db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+			t.Fatal(err)
+		}
+		return pages
+	}
+
+	_, err := db.Exec(`
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 20000)
+		INSERT INTO request_count (user_id, path, window_start, count) SELECT i, '/foo', 100, 1 FROM n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := pageCount()
+
+	deleted, err := store.Counters("request_count").DeleteBefore(ctx, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 20000 {
+		t.Fatalf("deleted = %d, want 20000", deleted)
+	}
+
+	freed, err := store.ReclaimSpace(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed < full/2 {
+		t.Errorf("freed pages = %d of %d, want most of them", freed, full)
+	}
+
+	var free int64
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&free); err != nil {
+		t.Fatal(err)
+	}
+	if pages := pageCount(); free != 0 || pages != full-freed {
+		t.Errorf("%d pages with %d free, want %d pages with none free", pages, free, full-freed)
+	}
+}
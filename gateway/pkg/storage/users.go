@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// User is a row of the users table, as exposed by the admin API.
+type User struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Rate      float64   `json:"rate"` // the quota of the plan if the user has no rate of their own
+	Plan      string    `json:"plan"`
+	Suspended bool      `json:"suspended"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// userRate selects the request rate of a user: their own quota, or the current quota of their plan if it is 0.
+// Users follow the changes of their plan, since its quota is not copied.
+const userRate = `CASE WHEN quota > 0 THEN quota ELSE COALESCE((SELECT plans.quota FROM plans WHERE plans.name = users.plan), 0) END`
+
+// UserFilter holds the pagination and filtering options for listing users.
+type UserFilter struct {
+	Name      string // case-insensitive substring of the user name
+	Suspended *bool
+	Limit     int
+	Offset    int
+}
+
+// UserQuota returns the request rate of a user.
+// Suspended users and ids that are not integers are reported as ErrUserNotFound.
+func (s *Store) UserQuota(ctx context.Context, userId string) (float64, error) {
+	if _, err := strconv.ParseInt(userId, 10, 64); err != nil {
+		return 0, ErrUserNotFound
+	}
+
+	var quota float64
+	err := s.db.QueryRowContext(ctx, s.Rebind(`
+	SELECT `+userRate+` FROM users WHERE id = ? AND NOT suspended`),
+		userId,
+	).Scan(&quota)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return quota, err
+}
+
+// ListUsers returns a page of the users matching the filter, and the number of matching users.
+func (s *Store) ListUsers(ctx context.Context, filter UserFilter) ([]User, int, error) {
+	where := " WHERE LOWER(name) LIKE LOWER(?)"
+	args := []any{"%" + filter.Name + "%"}
+	if filter.Suspended != nil {
+		where += " AND suspended = ?"
+		args = append(args, *filter.Suspended)
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, s.Rebind("SELECT COUNT(*) FROM users"+where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.Rebind(`
+	SELECT id, name, `+userRate+`, plan, suspended, created_at FROM users`+where+`
+	ORDER BY id LIMIT ? OFFSET ?`),
+		append(args, filter.Limit, filter.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Id, &u.Name, &u.Rate, &u.Plan, &u.Suspended, &u.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+
+	return users, total, rows.Err()
+}
+
+// GetUser returns a user, or ErrUserNotFound.
+func (s *Store) GetUser(ctx context.Context, userId string) (*User, error) {
+	var u User
+	err := s.db.QueryRowContext(ctx, s.Rebind(`
+	SELECT id, name, `+userRate+`, plan, suspended, created_at FROM users WHERE id = ?`),
+		userId,
+	).Scan(&u.Id, &u.Name, &u.Rate, &u.Plan, &u.Suspended, &u.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateUser inserts a new user, or fails with ErrUserExists.
+// If the id is 0, the next free id is assigned.
+func (s *Store) CreateUser(ctx context.Context, u *User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.InsertUser(ctx, tx, u); err != nil {
+			return err
+		}
+		// the id may be cached as unknown
+		return s.LogUserChange(ctx, tx, strconv.FormatInt(u.Id, 10))
+	})
+}
+
+// InsertUser inserts a user in a transaction, or fails with ErrUserExists.
+// A zero id picks the next free one, and u.Id is set to it.
+// On PostgreSQL, concurrent transactions may pick the same MAX(id) + 1: all but one conflict and pick again.
+// Every conflict means that another user was inserted, so the retries end.
+func (s *Store) InsertUser(ctx context.Context, tx *sql.Tx, u *User) error {
+	u.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	var id any
+	if u.Id != 0 {
+		id = u.Id
+	}
+
+	for {
+		err := tx.QueryRowContext(ctx, s.Rebind(`
+		INSERT INTO users (id, name, quota, plan, suspended, created_at)
+		VALUES (COALESCE(?, (SELECT COALESCE(MAX(id), 0) + 1 FROM users)), ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING id`),
+			id, u.Name, u.Rate, u.Plan, u.Suspended, u.CreatedAt.Format(time.RFC3339),
+		).Scan(&u.Id)
+
+		if err == sql.ErrNoRows && id == nil {
+			// a concurrent insert took the id, the next statement sees it
+			continue
+		}
+		if err == sql.ErrNoRows {
+			return ErrUserExists
+		}
+		return err
+	}
+}
+
+// UpdateUser changes the name and/or the rate of a user. Nil fields are left unchanged.
+func (s *Store) UpdateUser(ctx context.Context, userId string, name *string, rate *float64) error {
+	return s.changeUser(ctx, userId, `
+	UPDATE users SET name = COALESCE(?, name), quota = COALESCE(?, quota) WHERE id = ?`,
+		name, rate, userId,
+	)
+}
+
+// DeleteUser deletes a user, or fails with ErrUserNotFound.
+func (s *Store) DeleteUser(ctx context.Context, userId string) error {
+	return s.changeUser(ctx, userId, "DELETE FROM users WHERE id = ?", userId)
+}
+
+// SetUserSuspended suspends or unsuspends a user.
+func (s *Store) SetUserSuspended(ctx context.Context, userId string, suspended bool) error {
+	return s.changeUser(ctx, userId, "UPDATE users SET suspended = ? WHERE id = ?", suspended, userId)
+}
+
+// changeUser runs a statement changing a user, and records the change in the same transaction.
+// It fails with ErrUserNotFound if the statement didn't affect any row.
+func (s *Store) changeUser(ctx context.Context, userId string, query string, args ...any) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res); err != nil {
+			return err
+		}
+		return s.LogUserChange(ctx, tx, userId)
+	})
+}
+
+// expectOneRow returns ErrUserNotFound if the statement didn't affect any row.
+func expectOneRow(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
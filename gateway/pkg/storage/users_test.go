@@ -0,0 +1,217 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gateway/pkg/config"
+	"gateway/pkg/migrations"
+	"gateway/pkg/storage"
+)
+
+// openStores returns a migrated store for every backend to test: SQLite always,
+// and PostgreSQL if GATEWAY_TEST_DATABASE_URL is set to a postgres:// URL.
+// Each PostgreSQL store uses its own schema, dropped at the end of the test.
+// In CI, where the CI variable is set, a missing GATEWAY_TEST_DATABASE_URL fails the test instead of skipping postgres.
+func openStores(t *testing.T) map[string]*storage.Store {
+	t.Helper()
+	return openConfiguredStores(t, config.Config{})
+}
+
+// openConfiguredStores is openStores with the settings of cfg other than the storage ones.
+func openConfiguredStores(t *testing.T, cfg config.Config) map[string]*storage.Store {
+	t.Helper()
+	ctx := context.Background()
+
+	sqliteConf := cfg
+	sqliteConf.Storage = storage.SQLite
+	sqliteConf.DBFile = filepath.Join(t.TempDir(), "limiter.db")
+	stores := map[string]*storage.Store{
+		storage.SQLite: openStore(t, &sqliteConf),
+	}
+
+	databaseURL := os.Getenv("GATEWAY_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("GATEWAY_TEST_DATABASE_URL must be set in CI")
+		}
+		t.Log("GATEWAY_TEST_DATABASE_URL is not set, skipping postgres")
+		return stores
+	}
+
+	admin, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("gateway_test_%d", time.Now().UnixNano())
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	postgresConf := cfg
+	postgresConf.Storage = storage.Postgres
+	postgresConf.DatabaseURL = config.Secret(u.String())
+	stores[storage.Postgres] = openStore(t, &postgresConf)
+	return stores
+}
+
+func openStore(t testing.TB, cfg *config.Config) *storage.Store {
+	t.Helper()
+	ctx := context.Background()
+
+	store, err := storage.Open(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	migrator, err := migrations.New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCreateUser(t *testing.T) {
+	for dialect, store := range openStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			ctx := context.Background()
+
+			u := storage.User{Name: "new", Rate: 2}
+			if err := store.CreateUser(ctx, &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Id != 3 {
+				t.Errorf("id = %d, want 3, after the seeded users", u.Id)
+			}
+
+			got, err := store.GetUser(ctx, "3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != "new" || got.Rate != 2 {
+				t.Errorf("user = %+v, want %+v", got, u)
+			}
+
+			err = store.CreateUser(ctx, &storage.User{Id: 3, Name: "again", Rate: 1})
+			if !errors.Is(err, storage.ErrUserExists) {
+				t.Errorf("creating an existing id: err = %v, want %v", err, storage.ErrUserExists)
+			}
+		})
+	}
+}
+
+func TestCreateUserConcurrent(t *testing.T) {
+	const users = 20
+
+	for dialect, store := range openStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			ctx := context.Background()
+
+			ids := make([]int64, users)
+			errs := make([]error, users)
+			var wg sync.WaitGroup
+			for i := range users {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					u := storage.User{Name: fmt.Sprintf("user %d", i), Rate: 1}
+					errs[i] = store.CreateUser(ctx, &u)
+					ids[i] = u.Id
+				}()
+			}
+			wg.Wait()
+
+			seen := map[int64]bool{}
+			for i := range users {
+				if errs[i] != nil {
+					t.Fatalf("user %d: %v", i, errs[i])
+				}
+				if seen[ids[i]] {
+					t.Errorf("id %d assigned twice", ids[i])
+				}
+				seen[ids[i]] = true
+			}
+
+			_, total, err := store.ListUsers(ctx, storage.UserFilter{Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := users + 3; total != want {
+				t.Errorf("total = %d, want %d", total, want)
+			}
+		})
+	}
+}
+
+func TestUserQuotaFollowsPlan(t *testing.T) {
+	for dialect, store := range openStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			ctx := context.Background()
+
+			setPlan := func(quota float64) {
+				t.Helper()
+				_, err := store.DB().ExecContext(ctx, store.Rebind(`
+				INSERT INTO plans (name, quota) VALUES ('pro', ?)
+				ON CONFLICT (name) DO UPDATE SET quota = excluded.quota`),
+					quota,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			setPlan(5)
+
+			following := storage.User{Name: "following", Plan: "pro"}
+			own := storage.User{Name: "own", Rate: 2, Plan: "pro"}
+			for _, u := range []*storage.User{&following, &own} {
+				if err := store.CreateUser(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func(u storage.User, want float64) {
+				t.Helper()
+				quota, err := store.UserQuota(ctx, fmt.Sprint(u.Id))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if quota != want {
+					t.Errorf("quota of %s = %v, want %v", u.Name, quota, want)
+				}
+			}
+			check(following, 5)
+			check(own, 2)
+
+			setPlan(9)
+			check(following, 9)
+			check(own, 2)
+		})
+	}
+}
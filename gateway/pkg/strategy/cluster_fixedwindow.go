@@ -0,0 +1,151 @@
+package strategy
+
+import (
+	"gateway/pkg/cluster"
+	"sync"
+	"time"
+)
+
+// ClusterFixedWindow strategy counts the requests of each window in memory, adding the requests
+// accepted by the cluster peers, so a user gets the window limit once across the cluster.
+// The counts of past windows are dropped once per window.
+type ClusterFixedWindow struct {
+	LengthSeconds int
+	Node          *cluster.Node
+
+	mu     sync.Mutex
+	counts map[string]map[string]*windowCount // path -> userId -> count of the latest window
+	swept  int64                              // start of the window the counts were last dropped in
+}
+
+type windowCount struct {
+	start int64
+	count int
+}
+
+// Accept counts the request in the current window, if the window count is below the number
+// of requests allowed by the user rate over the window length and the cluster allows it,
+// see cluster.Node.Take.
+func (fw *ClusterFixedWindow) Accept(userId string, requestsPerSecond float64, path string) (bool, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	maxRequests := int(requestsPerSecond * float64(fw.LengthSeconds))
+
+	if fw.swept != windowStart {
+		fw.swept = windowStart
+		dropPastWindows(fw.counts, windowStart)
+	}
+
+	wc := fw.windowCount(userId, path, windowStart)
+	key := cluster.Key{Path: path, UserId: userId, Window: windowStart}
+	if !fw.Node.Take(key, float64(wc.count), float64(maxRequests)) {
+		return false, nil
+	}
+
+	wc.count++
+	return true, nil
+}
+
+// Merge adds the requests accepted by a peer to the count of a user.
+// Requests counted in another window, because it is over or because of clock skew, are ignored.
+func (fw *ClusterFixedWindow) Merge(userId string, path string, window int64, count int) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if window != fw.currentWindowStart() {
+		return
+	}
+
+	wc := fw.windowCount(userId, path, window)
+	wc.count = max(0, wc.count+count)
+}
+
+// State returns the request count of a user in the current window.
+func (fw *ClusterFixedWindow) State(userId string, path string) (State, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	count := 0
+	if wc, found := fw.counts[path][userId]; found && wc.start == windowStart {
+		count = wc.count
+	}
+
+	start := time.Unix(windowStart, 0)
+	return State{
+		Path:          path,
+		Strategy:      "fixed_window",
+		WindowStart:   &start,
+		WindowSeconds: fw.LengthSeconds,
+		Count:         &count,
+	}, nil
+}
+
+// Reset clears the request count of a user in the current window, on every node of the cluster.
+func (fw *ClusterFixedWindow) Reset(userId string, path string) error {
+	fw.mu.Lock()
+	count := 0
+	if wc, found := fw.counts[path][userId]; found && wc.start == fw.currentWindowStart() {
+		count = wc.count
+	}
+	fw.mu.Unlock()
+
+	return fw.TopUp(userId, path, count)
+}
+
+// TopUp lowers the request count of a user in the current window, on every node of the cluster.
+func (fw *ClusterFixedWindow) TopUp(userId string, path string, amount int) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	wc := fw.windowCount(userId, path, windowStart)
+	wc.count = max(0, wc.count-amount)
+
+	fw.Node.Record(cluster.Key{Path: path, UserId: userId, Window: windowStart}, -amount)
+	return nil
+}
+
+// TrackedKeys returns the number of counts kept in memory.
+func (fw *ClusterFixedWindow) TrackedKeys() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return countKeys(fw.counts)
+}
+
+// windowCount returns the count of a user, starting a new count if it belongs to a window before windowStart.
+// The caller must hold the lock.
+func (fw *ClusterFixedWindow) windowCount(userId string, path string, windowStart int64) *windowCount {
+	if fw.counts == nil {
+		fw.counts = map[string]map[string]*windowCount{}
+	}
+	if fw.counts[path] == nil {
+		fw.counts[path] = map[string]*windowCount{}
+	}
+
+	wc, found := fw.counts[path][userId]
+	if !found || wc.start < windowStart {
+		wc = &windowCount{start: windowStart}
+		fw.counts[path][userId] = wc
+	}
+	return wc
+}
+
+// dropPastWindows drops the counts of the windows before windowStart, which no longer limit.
+// The caller must hold the lock of the counts.
+func dropPastWindows[C interface{ windowStart() int64 }](counts map[string]map[string]C, windowStart int64) {
+	dropKeys(counts, func(c C) bool { return c.windowStart() < windowStart })
+}
+
+func (wc *windowCount) windowStart() int64 {
+	return wc.start
+}
+
+// currentWindowStart returns the start of the current window, in Unix seconds.
+func (fw *ClusterFixedWindow) currentWindowStart() int64 {
+	nowSeconds := time.Now().Unix()
+	return nowSeconds - (nowSeconds % int64(fw.LengthSeconds))
+}
@@ -0,0 +1,119 @@
+package strategy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gateway/pkg/cluster"
+	"gateway/pkg/config"
+	errorlog "gateway/pkg/error-log"
+)
+
+// newClusterNode creates a cluster node listening on address, with the given peers, and its logger.
+// The node isn't started: it has no ring until it syncs with its peers, see cluster.Node.Run.
+func newClusterNode(t *testing.T, address string, peers []string, handlers cluster.Handlers) (*cluster.Node, *errorlog.Logger) {
+	t.Helper()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gateway.hcl")
+	quoted := make([]string, len(peers))
+	for i, p := range peers {
+		quoted[i] = fmt.Sprintf("%q", p)
+	}
+	src := fmt.Sprintf(`
+gateway {
+  address  = "localhost:0"
+  log_file = "gateway.log"
+  db_file  = "limiter.db"
+}
+api {
+  address = "localhost:0"
+  key     = "api-key"
+}
+cluster {
+  address          = %q
+  peers            = [%s]
+  key              = "cluster-key"
+  sync_interval_ms = 50
+}
+`, address, strings.Join(quoted, ", "))
+	if err := os.WriteFile(file, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := config.Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := raw.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger, err := errorlog.New(conf.LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(logger.Close)
+
+	return cluster.New(conf, logger, handlers), logger
+}
+
+func TestClusterTokenBucketDropsIdleBuckets(t *testing.T) {
+	node, _ := newClusterNode(t, "localhost:7946", []string{"localhost:1"}, cluster.Handlers{})
+	tb := &ClusterTokenBucket{Capacity: 2, Node: node, IdleTimeout: 50 * time.Millisecond}
+
+	// 1 refills in 50ms, 2 doesn't
+	expectAcceptUser(t, tb, "1", 100, true)
+	expectAcceptUser(t, tb, "2", 1, true)
+	if keys := tb.TrackedKeys(); keys != 2 {
+		t.Fatalf("tracked keys = %d, want 2", keys)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	expectAcceptUser(t, tb, "3", 1, true)
+	if keys := tb.TrackedKeys(); keys != 2 {
+		t.Errorf("tracked keys = %d, want 2: the full bucket of user 1 dropped", keys)
+	}
+
+	// the bucket of user 2 was kept, with the token taken
+	state, err := tb.State("2", "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Tokens == nil || *state.Tokens != 1 {
+		t.Errorf("tokens of user 2 = %v, want 1", state.Tokens)
+	}
+}
+
+func TestClusterFixedWindowDropsPastWindows(t *testing.T) {
+	node, _ := newClusterNode(t, "localhost:7946", []string{"localhost:1"}, cluster.Handlers{})
+	fw := &ClusterFixedWindow{LengthSeconds: 1, Node: node}
+
+	expectAcceptUser(t, fw, "1", 10, true)
+	if keys := fw.TrackedKeys(); keys != 1 {
+		t.Fatalf("tracked keys = %d, want 1", keys)
+	}
+
+	// wait for the next window
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)))
+	expectAcceptUser(t, fw, "2", 10, true)
+	if keys := fw.TrackedKeys(); keys != 1 {
+		t.Errorf("tracked keys = %d, want 1: the count of user 1 dropped", keys)
+	}
+}
+
+func expectAcceptUser(t *testing.T, s acceptor, userId string, rate float64, want bool) {
+	t.Helper()
+	accepted, err := s.Accept(userId, rate, "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != want {
+		t.Fatalf("user %s: accepted = %v, want %v", userId, accepted, want)
+	}
+}
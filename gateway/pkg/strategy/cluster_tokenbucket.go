@@ -0,0 +1,187 @@
+package strategy
+
+import (
+	"gateway/pkg/cluster"
+	"math"
+	"sync"
+	"time"
+)
+
+// ClusterTokenBucket strategy keeps token buckets in memory, and takes the tokens consumed
+// on the cluster peers from them as well, so a user gets the capacity once across the cluster.
+// Unlike TokenBucket, tokens are refilled continuously and the bucket of a new user starts full.
+// Full buckets that aren't used for IdleTimeout are dropped, which doesn't change the limits.
+type ClusterTokenBucket struct {
+	Capacity    int
+	Node        *cluster.Node
+	IdleTimeout time.Duration // 0 keeps idle buckets
+
+	mu        sync.Mutex
+	buckets   map[string]map[string]*clusterBucket // path -> userId -> bucket
+	lastSweep time.Time
+}
+
+type clusterBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	rate       float64 // of the last request, to refill when peers consume tokens
+}
+
+// Accept refills the bucket based on the elapsed time since the last refill and consumes a token,
+// if one is available and the cluster allows it, see cluster.Node.Take.
+func (tb *ClusterTokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	if tb.IdleTimeout > 0 && now.Sub(tb.lastSweep) >= tb.IdleTimeout {
+		tb.lastSweep = now
+		dropIdleBuckets(tb.buckets, now, tb.IdleTimeout, tb.Capacity)
+	}
+
+	b := tb.bucket(userId, path)
+	b.rate = refillRate
+	b.refill(now, tb.Capacity)
+
+	capacity := float64(tb.Capacity)
+	if !tb.Node.Take(cluster.Key{Path: path, UserId: userId}, capacity-b.tokens, capacity) {
+		return false, nil
+	}
+
+	b.tokens--
+	return true, nil
+}
+
+// Merge takes the tokens consumed on a peer from the bucket of a user, or gives them back if count is negative.
+func (tb *ClusterTokenBucket) Merge(userId string, path string, window int64, count int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b := tb.bucket(userId, path)
+	b.refill(time.Now(), tb.Capacity)
+	b.tokens = min(float64(tb.Capacity), max(0, b.tokens-float64(count)))
+}
+
+// State returns the tokens left now, refilled at the rate of the last request, and the last refill time.
+// Users without a bucket have no tokens and no last refill time.
+func (tb *ClusterTokenBucket) State(userId string, path string) (State, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	state := State{
+		Path:     path,
+		Strategy: "token_bucket",
+		Capacity: tb.Capacity,
+	}
+
+	if found, ok := tb.buckets[path][userId]; ok {
+		b := *found
+		b.refill(time.Now(), tb.Capacity)
+		tokens := int(math.Floor(b.tokens))
+		lastRefill := b.lastRefill
+		state.Tokens = &tokens
+		state.LastRefill = &lastRefill
+	}
+
+	return state, nil
+}
+
+// Reset fills the bucket of a user, on every node of the cluster.
+func (tb *ClusterTokenBucket) Reset(userId string, path string) error {
+	return tb.TopUp(userId, path, tb.Capacity)
+}
+
+// TopUp adds tokens to the bucket of a user, up to its capacity, on every node of the cluster.
+func (tb *ClusterTokenBucket) TopUp(userId string, path string, amount int) error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b := tb.bucket(userId, path)
+	b.refill(time.Now(), tb.Capacity)
+	b.tokens = min(float64(tb.Capacity), b.tokens+float64(amount))
+
+	tb.Node.Record(cluster.Key{Path: path, UserId: userId}, -amount)
+	return nil
+}
+
+// Configure changes the idle timeout.
+func (tb *ClusterTokenBucket) Configure(idleTimeout time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.IdleTimeout = idleTimeout
+}
+
+// TrackedKeys returns the number of buckets kept in memory.
+func (tb *ClusterTokenBucket) TrackedKeys() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return countKeys(tb.buckets)
+}
+
+// bucket returns the bucket of a user, creating a full one if needed.
+// The caller must hold the lock.
+func (tb *ClusterTokenBucket) bucket(userId string, path string) *clusterBucket {
+	if tb.buckets == nil {
+		tb.buckets = map[string]map[string]*clusterBucket{}
+	}
+	if tb.buckets[path] == nil {
+		tb.buckets[path] = map[string]*clusterBucket{}
+	}
+
+	b, found := tb.buckets[path][userId]
+	if !found {
+		b = &clusterBucket{tokens: float64(tb.Capacity), lastRefill: time.Now()}
+		tb.buckets[path][userId] = b
+	}
+	return b
+}
+
+func (b *clusterBucket) refill(now time.Time, capacity int) {
+	b.tokens = min(float64(capacity), b.tokens+now.Sub(b.lastRefill).Seconds()*b.rate)
+	b.lastRefill = now
+}
+
+// idle reports whether a bucket wasn't used for the idle timeout and is full again, so it can be dropped.
+func (b *clusterBucket) idle(now time.Time, idleTimeout time.Duration, capacity int) bool {
+	elapsed := now.Sub(b.lastRefill)
+	return elapsed >= idleTimeout && b.tokens+elapsed.Seconds()*b.rate >= float64(capacity)
+}
+
+// idleBucket is a bucket that can tell whether it is idle, see clusterBucket.idle.
+type idleBucket interface {
+	idle(now time.Time, idleTimeout time.Duration, capacity int) bool
+}
+
+// dropIdleBuckets drops the idle buckets. The caller must hold the lock of the buckets.
+func dropIdleBuckets[B idleBucket](buckets map[string]map[string]B, now time.Time, idleTimeout time.Duration, capacity int) {
+	dropped := dropKeys(buckets, func(b B) bool { return b.idle(now, idleTimeout, capacity) })
+	tokenBucketMetrics.Add(metricIdleEvictions, int64(dropped))
+}
+
+// dropKeys drops the values of the users for which drop returns true, and returns how many.
+func dropKeys[V any](values map[string]map[string]V, drop func(V) bool) int {
+	dropped := 0
+	for path, users := range values {
+		for userId, v := range users {
+			if drop(v) {
+				delete(users, userId)
+				dropped++
+			}
+		}
+		if len(users) == 0 {
+			delete(values, path)
+		}
+	}
+	return dropped
+}
+
+// countKeys returns the number of users with a value, over every path.
+func countKeys[V any](values map[string]map[string]V) int {
+	keys := 0
+	for _, users := range values {
+		keys += len(users)
+	}
+	return keys
+}
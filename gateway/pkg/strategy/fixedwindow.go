@@ -2,87 +2,61 @@ package strategy
 
 import (
 	"context"
-	"database/sql"
-	"fmt"
-	errorlog "gateway/pkg/error-log"
+	"gateway/pkg/storage"
 	"time"
 )
 
 // FixedWindow strategy uses an SQL table to track request counts per user and path.
 type FixedWindow struct {
 	LengthSeconds int
-	SqlDb         *sql.DB
-	Logger        *errorlog.Logger
-	SqlTable      string
+	Counters      storage.Counters
 }
 
-// Accept checks if a request from a user for a specific path is allowed based on the fixed window strategy.
-// The algorithm:
-// - checks if there is an open window
-// - if there is, the window is used to check if the request can be accepted
-// - if there isn't, a new window is created. Older windows are deleted.
-func (fw *FixedWindow) Accept(userId string, requestsPerSecond float64, path string) bool {
+// Accept counts the request in the current window, if the window count is below
+// the number of requests allowed by the user rate over the window length.
+func (fw *FixedWindow) Accept(userId string, requestsPerSecond float64, path string) (bool, error) {
 
-	nowSeconds := time.Now().Unix()
-	currentWindowStart := nowSeconds - (nowSeconds % int64(fw.LengthSeconds))
+	currentWindowStart := fw.currentWindowStart()
 	maxRequests := int(requestsPerSecond * float64(fw.LengthSeconds))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	// Start a transaction
-	tx, err := fw.SqlDb.BeginTx(ctx, nil)
-	if err != nil {
-		fw.Logger.WriteError(fmt.Errorf("failed to begin tx: %w", err))
-		return false
-	}
-	defer tx.Rollback()
-
-	var count int
-	err = tx.QueryRowContext(ctx, `
-		SELECT count FROM `+fw.SqlTable+`
-		WHERE user_id = ? AND path = ? AND window_start = ?`,
-		userId, path, currentWindowStart,
-	).Scan(&count)
+	return fw.Counters.Increment(ctx, userId, path, currentWindowStart, maxRequests)
 
-	switch err {
-	case nil:
-		if count >= maxRequests {
-			return false
-		}
-		_, err = tx.ExecContext(ctx, `
-			UPDATE `+fw.SqlTable+`
-			SET count = count + 1
-			WHERE user_id = ? AND path = ? AND window_start = ?`,
-			userId, path, currentWindowStart,
-		)
-		if err != nil {
-			fw.Logger.WriteError(fmt.Errorf("sql update failed: %w", err))
-			return false
-		}
-	case sql.ErrNoRows:
-		fw.SqlDb.Exec("DELETE FROM "+fw.SqlTable+" WHERE window_start < ?", currentWindowStart)
+}
 
-		_, err = tx.ExecContext(ctx, `
-			INSERT INTO `+fw.SqlTable+` (user_id, path, window_start, count)
-			VALUES (?, ?, ?, 1)`,
-			userId, path, currentWindowStart,
-		)
-		if err != nil {
-			fw.Logger.WriteError(fmt.Errorf("sql insert failed: %w", err))
-			return false
-		}
+// State returns the request count of a user in the current window.
+func (fw *FixedWindow) State(userId string, path string) (State, error) {
+	windowStart := fw.currentWindowStart()
 
-	default:
-		fw.Logger.WriteError(fmt.Errorf("sql query failed: %w", err))
-		return false
+	count, err := fw.Counters.Count(context.Background(), userId, path, windowStart)
+	if err != nil {
+		return State{}, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		fw.Logger.WriteError(fmt.Errorf("sql commit failed: %w", err))
-		return false
-	}
+	start := time.Unix(windowStart, 0)
+	return State{
+		Path:          path,
+		Strategy:      "fixed_window",
+		WindowStart:   &start,
+		WindowSeconds: fw.LengthSeconds,
+		Count:         &count,
+	}, nil
+}
+
+// Reset deletes the request counts of a user.
+func (fw *FixedWindow) Reset(userId string, path string) error {
+	return fw.Counters.Reset(context.Background(), userId, path)
+}
 
-	return true
+// TopUp lowers the request count of a user in the current window.
+func (fw *FixedWindow) TopUp(userId string, path string, amount int) error {
+	return fw.Counters.TopUp(context.Background(), userId, path, fw.currentWindowStart(), amount)
+}
 
+// currentWindowStart returns the start of the current window, in Unix seconds.
+func (fw *FixedWindow) currentWindowStart() int64 {
+	nowSeconds := time.Now().Unix()
+	return nowSeconds - (nowSeconds % int64(fw.LengthSeconds))
 }
@@ -0,0 +1,30 @@
+package strategy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// redisTimeout bounds each round trip of the redis strategies.
+const redisTimeout = 2 * time.Second
+
+// instanceId tells apart the gateways sharing a redis server, in sliding window entries.
+var instanceId = newInstanceId()
+
+func newInstanceId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// redisKey returns the key holding the state of a user for a path, e.g. gateway:token_bucket:/foo:1.
+func redisKey(prefix string, strategy string, path string, userId string, suffix ...string) string {
+	return strings.Join(append([]string{prefix, strategy, path, userId}, suffix...), ":")
+}
+
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
@@ -0,0 +1,126 @@
+package strategy
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The counter is a hash with the start of its window, in Unix seconds, and the count of the window.
+// The window is computed from the redis clock, so the gateways don't need synchronized clocks.
+// The count of a past window is replaced, and the key expires at the end of its window.
+var fixedWindowAccept = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local length = tonumber(ARGV[2])
+local now = tonumber(redis.call('TIME')[1])
+local window = now - now % length
+
+local counter = redis.call('HMGET', KEYS[1], 'window', 'count')
+local count = 0
+if tonumber(counter[1]) == window then
+	count = tonumber(counter[2])
+end
+if count >= limit then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], 'window', tostring(window), 'count', tostring(count + 1))
+redis.call('EXPIREAT', KEYS[1], window + length)
+return 1
+`)
+
+// Returns the start of the current window and its count.
+var fixedWindowState = redis.NewScript(`
+local length = tonumber(ARGV[1])
+local now = tonumber(redis.call('TIME')[1])
+local window = now - now % length
+
+local counter = redis.call('HMGET', KEYS[1], 'window', 'count')
+if tonumber(counter[1]) == window then
+	return {window, tonumber(counter[2])}
+end
+return {window, 0}
+`)
+
+// Lowers the count of the current window, down to 0, keeping its expiry.
+var fixedWindowTopUp = redis.NewScript(`
+local length = tonumber(ARGV[1])
+local now = tonumber(redis.call('TIME')[1])
+local window = now - now % length
+
+local counter = redis.call('HMGET', KEYS[1], 'window', 'count')
+if tonumber(counter[1]) ~= window then
+	return 0
+end
+local count = tonumber(counter[2])
+local amount = math.min(count, tonumber(ARGV[2]))
+if amount > 0 then
+	redis.call('HSET', KEYS[1], 'count', tostring(count - amount))
+end
+return amount
+`)
+
+// RedisFixedWindow strategy counts the requests of each window in redis, so the counts are shared by the gateways.
+type RedisFixedWindow struct {
+	LengthSeconds int
+	Client        redis.Cmdable
+	KeyPrefix     string
+}
+
+// Accept counts the request in the current window, if the window count is below
+// the number of requests allowed by the user rate over the window length.
+// It returns an error if redis can't be reached.
+func (fw *RedisFixedWindow) Accept(userId string, requestsPerSecond float64, path string) (bool, error) {
+	maxRequests := int(requestsPerSecond * float64(fw.LengthSeconds))
+
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	accepted, err := fixedWindowAccept.Run(ctx, fw.Client, []string{fw.key(userId, path)}, maxRequests, fw.LengthSeconds).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return accepted == 1, nil
+}
+
+// State returns the request count of a user in the current window.
+func (fw *RedisFixedWindow) State(userId string, path string) (State, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	values, err := fixedWindowState.Run(ctx, fw.Client, []string{fw.key(userId, path)}, fw.LengthSeconds).Int64Slice()
+	if err != nil {
+		return State{}, err
+	}
+
+	start := time.Unix(values[0], 0)
+	count := int(values[1])
+	return State{
+		Path:          path,
+		Strategy:      "fixed_window",
+		WindowStart:   &start,
+		WindowSeconds: fw.LengthSeconds,
+		Count:         &count,
+	}, nil
+}
+
+// Reset deletes the request count of a user. Counts of past windows don't limit anymore.
+func (fw *RedisFixedWindow) Reset(userId string, path string) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return fw.Client.Del(ctx, fw.key(userId, path)).Err()
+}
+
+// TopUp lowers the request count of a user in the current window.
+func (fw *RedisFixedWindow) TopUp(userId string, path string, amount int) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return fixedWindowTopUp.Run(ctx, fw.Client, []string{fw.key(userId, path)}, fw.LengthSeconds, amount).Err()
+}
+
+func (fw *RedisFixedWindow) key(userId string, path string) string {
+	return redisKey(fw.KeyPrefix, "fixed_window", path, userId)
+}
@@ -0,0 +1,104 @@
+package strategy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The log is a sorted set of the accepted requests, scored by their time in milliseconds.
+// Requests older than the window are dropped before counting. The redis clock is used,
+// so the gateways don't need synchronized clocks.
+var slidingWindowAccept = redis.NewScript(`
+local window = tonumber(ARGV[1]) * 1000
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', tostring(now - window))
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], tostring(now), ARGV[3])
+redis.call('PEXPIRE', KEYS[1], window)
+return 1
+`)
+
+// Returns the current time, in milliseconds, and the number of requests accepted during the last window.
+var slidingWindowState = redis.NewScript(`
+local window = tonumber(ARGV[1]) * 1000
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+return {now, redis.call('ZCOUNT', KEYS[1], '(' .. tostring(now - window), '+inf')}
+`)
+
+// RedisSlidingWindow strategy logs the requests of each user in redis and limits the requests
+// made over the last window, so there is no burst at window boundaries.
+type RedisSlidingWindow struct {
+	LengthSeconds int
+	Client        redis.Cmdable
+	KeyPrefix     string
+
+	requests atomic.Uint64 // makes the log entries of this gateway unique
+}
+
+// Accept logs the request, if fewer requests than allowed by the user rate over the window length
+// were accepted during the last window. It returns an error if redis can't be reached.
+func (sw *RedisSlidingWindow) Accept(userId string, requestsPerSecond float64, path string) (bool, error) {
+	maxRequests := int(requestsPerSecond * float64(sw.LengthSeconds))
+	entry := fmt.Sprintf("%d-%s-%d", time.Now().UnixNano(), instanceId, sw.requests.Add(1))
+
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	accepted, err := slidingWindowAccept.Run(ctx, sw.Client, []string{sw.key(userId, path)}, sw.LengthSeconds, maxRequests, entry).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return accepted == 1, nil
+}
+
+// State returns the number of requests of a user during the last window.
+func (sw *RedisSlidingWindow) State(userId string, path string) (State, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	values, err := slidingWindowState.Run(ctx, sw.Client, []string{sw.key(userId, path)}, sw.LengthSeconds).Int64Slice()
+	if err != nil {
+		return State{}, err
+	}
+
+	start := time.UnixMilli(values[0]).Add(-time.Duration(sw.LengthSeconds) * time.Second)
+	count := int(values[1])
+	return State{
+		Path:          path,
+		Strategy:      "sliding_window",
+		WindowStart:   &start,
+		WindowSeconds: sw.LengthSeconds,
+		Count:         &count,
+	}, nil
+}
+
+// Reset deletes the request log of a user.
+func (sw *RedisSlidingWindow) Reset(userId string, path string) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return sw.Client.Del(ctx, sw.key(userId, path)).Err()
+}
+
+// TopUp removes the oldest requests from the log of a user.
+func (sw *RedisSlidingWindow) TopUp(userId string, path string, amount int) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return sw.Client.ZPopMin(ctx, sw.key(userId, path), int64(amount)).Err()
+}
+
+func (sw *RedisSlidingWindow) key(userId string, path string) string {
+	return redisKey(sw.KeyPrefix, "sliding_window", path, userId)
+}
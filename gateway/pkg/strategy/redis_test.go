@@ -0,0 +1,222 @@
+package strategy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisClock is a miniredis server whose clock only moves when advanced.
+// The scripts read the time with the TIME command, so it is the clock of the limits.
+type redisClock struct {
+	*miniredis.Miniredis
+	now time.Time
+}
+
+// The server clock starts at the beginning of a 10 seconds window, far from the clock of the gateway.
+func newRedisClock(t *testing.T) (*redisClock, redis.Cmdable) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	clock := &redisClock{Miniredis: server, now: time.Unix(1_000_000_000, 0)}
+	server.SetTime(clock.now)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return clock, client
+}
+
+// advance moves the server clock, and expires the keys.
+func (c *redisClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.SetTime(c.now)
+	c.FastForward(d)
+}
+
+type acceptor interface {
+	Accept(userId string, requestsPerSecond float64, path string) (bool, error)
+}
+
+func expectAccept(t *testing.T, s acceptor, rate float64, want ...bool) {
+	t.Helper()
+	for i, w := range want {
+		accepted, err := s.Accept("1", rate, "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted != w {
+			t.Fatalf("request %d: accepted = %v, want %v", i+1, accepted, w)
+		}
+	}
+}
+
+func TestRedisTokenBucket(t *testing.T) {
+	clock, client := newRedisClock(t)
+	tb := &RedisTokenBucket{Capacity: 2, Client: client, KeyPrefix: "test"}
+	key := tb.key("1", "/foo")
+
+	// a new bucket starts full
+	expectAccept(t, tb, 1, true, true, false)
+
+	state, err := tb.State("1", "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *state.Tokens != 0 || !state.LastRefill.Equal(clock.now) {
+		t.Errorf("state = %d tokens at %v, want 0 at %v", *state.Tokens, state.LastRefill, clock.now)
+	}
+
+	clock.advance(time.Second)
+	expectAccept(t, tb, 1, true, false)
+
+	if err := tb.TopUp("1", "/foo", 5); err != nil {
+		t.Fatal(err)
+	}
+	// up to the capacity
+	expectAccept(t, tb, 1, true, true, false)
+
+	if err := tb.Reset("1", "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, tb, 1, true, true, false)
+
+	// the key expires once the bucket is full again
+	clock.advance(1900 * time.Millisecond)
+	if !clock.Exists(key) {
+		t.Fatal("bucket expired before being full")
+	}
+	clock.advance(200 * time.Millisecond)
+	if clock.Exists(key) {
+		t.Fatal("full bucket didn't expire")
+	}
+	expectAccept(t, tb, 1, true, true, false)
+}
+
+func TestRedisTokenBucketTopUpMissing(t *testing.T) {
+	clock, client := newRedisClock(t)
+	tb := &RedisTokenBucket{Capacity: 2, Client: client, KeyPrefix: "test"}
+
+	// a missing bucket is already full
+	if err := tb.TopUp("1", "/foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if clock.Exists(tb.key("1", "/foo")) {
+		t.Error("top-up created a bucket")
+	}
+	expectAccept(t, tb, 1, true, true, false)
+}
+
+func TestRedisFixedWindow(t *testing.T) {
+	clock, client := newRedisClock(t)
+	fw := &RedisFixedWindow{LengthSeconds: 10, Client: client, KeyPrefix: "test"}
+	key := fw.key("1", "/foo")
+
+	// 0.2 requests per second over 10 seconds
+	clock.advance(3 * time.Second)
+	expectAccept(t, fw, 0.2, true, true, false)
+
+	state, err := fw.State("1", "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	windowStart := time.Unix(1_000_000_000, 0)
+	if *state.Count != 2 || !state.WindowStart.Equal(windowStart) {
+		t.Errorf("state = %d requests since %v, want 2 since %v", *state.Count, state.WindowStart, windowStart)
+	}
+
+	if err := fw.TopUp("1", "/foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, fw, 0.2, true, false)
+
+	if err := fw.Reset("1", "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, fw, 0.2, true, true, false)
+
+	// the counter expires at the end of the window
+	clock.advance(6 * time.Second)
+	if !clock.Exists(key) {
+		t.Fatal("counter expired before the end of the window")
+	}
+	clock.advance(time.Second)
+	if clock.Exists(key) {
+		t.Fatal("counter didn't expire at the end of the window")
+	}
+	expectAccept(t, fw, 0.2, true, true, false)
+}
+
+func TestRedisFixedWindowNextWindow(t *testing.T) {
+	clock, client := newRedisClock(t)
+	fw := &RedisFixedWindow{LengthSeconds: 10, Client: client, KeyPrefix: "test"}
+
+	expectAccept(t, fw, 0.2, true, true, false)
+
+	// a counter of a past window that didn't expire yet doesn't count in the next window
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.SetTime(clock.now)
+	expectAccept(t, fw, 0.2, true)
+
+	state, err := fw.State("1", "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *state.Count != 1 || !state.WindowStart.Equal(clock.now) {
+		t.Errorf("state = %d requests since %v, want 1 since %v", *state.Count, state.WindowStart, clock.now)
+	}
+
+	// top-ups only lower the count of the current window
+	clock.now = clock.now.Add(10 * time.Second)
+	clock.SetTime(clock.now)
+	if err := fw.TopUp("1", "/foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, fw, 0.2, true, true, false)
+}
+
+func TestRedisSlidingWindow(t *testing.T) {
+	clock, client := newRedisClock(t)
+	sw := &RedisSlidingWindow{LengthSeconds: 10, Client: client, KeyPrefix: "test"}
+	key := sw.key("1", "/foo")
+
+	// 0.2 requests per second over the last 10 seconds
+	expectAccept(t, sw, 0.2, true)
+	clock.advance(4 * time.Second)
+	expectAccept(t, sw, 0.2, true, false)
+
+	state, err := sw.State("1", "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	windowStart := clock.now.Add(-10 * time.Second)
+	if *state.Count != 2 || !state.WindowStart.Equal(windowStart) {
+		t.Errorf("state = %d requests since %v, want 2 since %v", *state.Count, state.WindowStart, windowStart)
+	}
+
+	// the first request leaves the window
+	clock.advance(6 * time.Second)
+	expectAccept(t, sw, 0.2, true, false)
+
+	if err := sw.TopUp("1", "/foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, sw, 0.2, true, false)
+
+	if err := sw.Reset("1", "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectAccept(t, sw, 0.2, true, true, false)
+
+	// the log expires a window after the last accepted request
+	clock.advance(9 * time.Second)
+	if !clock.Exists(key) {
+		t.Fatal("log expired before the end of the window")
+	}
+	clock.advance(time.Second)
+	if clock.Exists(key) {
+		t.Fatal("log didn't expire at the end of the window")
+	}
+	expectAccept(t, sw, 0.2, true, true, false)
+}
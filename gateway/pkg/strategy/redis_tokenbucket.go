@@ -0,0 +1,129 @@
+package strategy
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The bucket is a hash with the tokens left and the time of the last refill, in milliseconds.
+// Tokens are refilled continuously, so they are fractional. The redis clock is used,
+// so the gateways don't need synchronized clocks. A missing bucket is full, so the key
+// expires once the bucket would be full again.
+var tokenBucketAccept = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+if tokens == nil then
+	tokens = capacity
+else
+	tokens = math.min(capacity, tokens + math.max(0, now - tonumber(bucket[2])) / 1000 * rate)
+end
+
+local accepted = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	accepted = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+if rate > 0 then
+	redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate * 1000) + 1)
+end
+return accepted
+`)
+
+// Adds tokens to an existing bucket, up to its capacity. Missing buckets are already full.
+var tokenBucketTopUp = redis.NewScript(`
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens == nil then
+	return 0
+end
+tokens = math.min(tonumber(ARGV[1]), tokens + tonumber(ARGV[2]))
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens))
+return 1
+`)
+
+// RedisTokenBucket strategy keeps token buckets in redis, so they are shared by the gateways.
+// Unlike TokenBucket, the bucket of a new user starts full.
+type RedisTokenBucket struct {
+	Capacity  int
+	Client    redis.Cmdable
+	KeyPrefix string
+}
+
+// Accept refills the bucket based on the elapsed time since the last request and consumes a token if one is available.
+// It returns an error if redis can't be reached.
+func (tb *RedisTokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	accepted, err := tokenBucketAccept.Run(ctx, tb.Client, []string{tb.key(userId, path)}, tb.Capacity, refillRate).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return accepted == 1, nil
+}
+
+// State returns the tokens left and the last refill time, as of the last request.
+// Users without a bucket have no tokens and no last refill time.
+func (tb *RedisTokenBucket) State(userId string, path string) (State, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	state := State{
+		Path:     path,
+		Strategy: "token_bucket",
+		Capacity: tb.Capacity,
+	}
+
+	values, err := tb.Client.HMGet(ctx, tb.key(userId, path), "tokens", "ts").Result()
+	if err != nil {
+		return State{}, err
+	}
+	if values[0] == nil || values[1] == nil {
+		return state, nil
+	}
+
+	tokens, err := strconv.ParseFloat(values[0].(string), 64)
+	if err != nil {
+		return State{}, err
+	}
+	ts, err := strconv.ParseInt(values[1].(string), 10, 64)
+	if err != nil {
+		return State{}, err
+	}
+
+	whole := int(math.Floor(tokens))
+	lastRefill := time.UnixMilli(ts)
+	state.Tokens = &whole
+	state.LastRefill = &lastRefill
+	return state, nil
+}
+
+// Reset fills the bucket of a user.
+func (tb *RedisTokenBucket) Reset(userId string, path string) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return tb.Client.Del(ctx, tb.key(userId, path)).Err()
+}
+
+// TopUp adds tokens to the bucket of a user, up to its capacity.
+func (tb *RedisTokenBucket) TopUp(userId string, path string, amount int) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+
+	return tokenBucketTopUp.Run(ctx, tb.Client, []string{tb.key(userId, path)}, tb.Capacity, amount).Err()
+}
+
+func (tb *RedisTokenBucket) key(userId string, path string) string {
+	return redisKey(tb.KeyPrefix, "token_bucket", path, userId)
+}
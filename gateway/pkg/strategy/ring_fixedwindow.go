@@ -0,0 +1,266 @@
+package strategy
+
+import (
+	"gateway/pkg/cluster"
+	errorlog "gateway/pkg/error-log"
+	"sync"
+	"time"
+)
+
+// RingFixedWindow strategy counts the requests of each user on the cluster member owning the user.
+// The other members forward their requests to the owner. While the owner can't be reached, requests
+// are counted locally, against the share of the window limit of this gateway.
+// The counts of past windows are dropped once per window.
+type RingFixedWindow struct {
+	LengthSeconds int
+	Node          *cluster.Node
+	Logger        *errorlog.Logger
+
+	mu    sync.Mutex
+	owned map[string]map[string]*ringWindowCount // path -> userId -> count, for the users owned by this gateway
+	local map[string]map[string]*windowCount     // path -> userId -> count, for the requests decided locally
+	swept int64                                  // start of the window the counts were last dropped in
+}
+
+type ringWindowCount struct {
+	windowCount
+	epoch uint64 // of the ring when the count was last used, see cluster.Node.Claim
+}
+
+// Accept forwards the request to the owner of the user, or decides on it if this gateway is the owner.
+func (fw *RingFixedWindow) Accept(userId string, requestsPerSecond float64, path string) (bool, error) {
+	owner, self, ok := fw.Node.Owner(cluster.RingKey(path, userId))
+	if ok && self {
+		return fw.AcceptOwned(userId, requestsPerSecond, path), nil
+	}
+
+	if ok {
+		accepted, err := fw.Node.Forward(owner, path, userId, requestsPerSecond)
+		if err == nil {
+			return accepted, nil
+		}
+		fw.Logger.WriteError(err)
+	}
+
+	fw.Node.LocalDecision()
+	return fw.acceptLocal(userId, requestsPerSecond, path), nil
+}
+
+// AcceptOwned decides on a request with the count of a user owned by this gateway.
+// After a change of the ring, the count of a user owned by another member until then is
+// handed off by that member. If it is down, and the change happened during the current window,
+// the window is considered full, so the requests it granted are not granted again.
+func (fw *RingFixedWindow) AcceptOwned(userId string, requestsPerSecond float64, path string) bool {
+	key := cluster.RingKey(path, userId)
+
+	fw.mu.Lock()
+	wc, found := fw.owned[path][userId]
+	epoch := uint64(0)
+	if found {
+		epoch = wc.epoch
+	}
+	fw.mu.Unlock()
+
+	claim := fw.Node.Claim(key, epoch, found)
+
+	var handedOff *cluster.KeyState
+	if !claim.Trusted && claim.From != "" {
+		state, err := fw.Node.HandOff(claim.From, path, userId)
+		if err != nil {
+			fw.Logger.WriteError(err)
+			claim.From = ""
+		}
+		handedOff = state
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	maxRequests := int(requestsPerSecond * float64(fw.LengthSeconds))
+	fw.sweep(windowStart)
+
+	wc, found = fw.owned[path][userId]
+	switch {
+	case found && wc.epoch == claim.Epoch:
+		// claimed meanwhile by another request
+	case claim.Trusted && found:
+	case claim.Trusted, claim.From != "" && handedOff == nil:
+		wc = &ringWindowCount{windowCount: windowCount{start: windowStart}}
+	case claim.From != "":
+		wc = &ringWindowCount{windowCount: windowCount{start: handedOff.Window, count: handedOff.Count}}
+	case claim.Since.Unix() >= windowStart:
+		wc = &ringWindowCount{windowCount: windowCount{start: windowStart, count: maxRequests}}
+	default:
+		wc = &ringWindowCount{windowCount: windowCount{start: windowStart}}
+	}
+	if wc.start < windowStart {
+		wc.windowCount = windowCount{start: windowStart}
+	}
+	wc.epoch = claim.Epoch
+
+	if fw.owned == nil {
+		fw.owned = map[string]map[string]*ringWindowCount{}
+	}
+	if fw.owned[path] == nil {
+		fw.owned[path] = map[string]*ringWindowCount{}
+	}
+	fw.owned[path][userId] = wc
+
+	if wc.count >= maxRequests {
+		return false
+	}
+	wc.count++
+	return true
+}
+
+// HandOff removes the count of a user now owned by another member, and returns it.
+func (fw *RingFixedWindow) HandOff(userId string, path string) *cluster.KeyState {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	wc, found := fw.owned[path][userId]
+	if !found {
+		return nil
+	}
+	delete(fw.owned[path], userId)
+
+	return &cluster.KeyState{Window: wc.start, Count: wc.count}
+}
+
+// acceptLocal decides on a request with a count limited to the share of this gateway.
+func (fw *RingFixedWindow) acceptLocal(userId string, requestsPerSecond float64, path string) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	maxRequests := int(requestsPerSecond * float64(fw.LengthSeconds) * fw.Node.Share())
+	fw.sweep(windowStart)
+
+	if fw.local == nil {
+		fw.local = map[string]map[string]*windowCount{}
+	}
+	if fw.local[path] == nil {
+		fw.local[path] = map[string]*windowCount{}
+	}
+	wc, found := fw.local[path][userId]
+	if !found || wc.start < windowStart {
+		wc = &windowCount{start: windowStart}
+		fw.local[path][userId] = wc
+	}
+
+	if wc.count >= maxRequests {
+		return false
+	}
+	wc.count++
+	return true
+}
+
+// State returns the request count in the current window of a user owned by this gateway.
+func (fw *RingFixedWindow) State(userId string, path string) (State, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	windowStart := fw.currentWindowStart()
+	count := 0
+	if wc, found := fw.owned[path][userId]; found && wc.start == windowStart {
+		count = wc.count
+	}
+
+	start := time.Unix(windowStart, 0)
+	return State{
+		Path:          path,
+		Strategy:      "fixed_window",
+		WindowStart:   &start,
+		WindowSeconds: fw.LengthSeconds,
+		Count:         &count,
+	}, nil
+}
+
+// Reset clears the request count of a user, on the gateway owning the user.
+// Without a ring, the local count is cleared too, since requests are counted with it.
+// It fails with cluster.ErrNotOwner if the owner disagrees about owning the user, or cluster.ErrPeerFailed.
+func (fw *RingFixedWindow) Reset(userId string, path string) error {
+	owner, self, ok := fw.Node.Owner(cluster.RingKey(path, userId))
+	if ok && !self {
+		return fw.Node.ForwardReset(owner, path, userId)
+	}
+
+	fw.ResetOwned(userId, path)
+	if !ok {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+
+		if wc, found := fw.local[path][userId]; found {
+			wc.count = 0
+		}
+	}
+	return nil
+}
+
+// TopUp lowers the request count in the current window of a user, on the gateway owning the user.
+// Without a ring, the local count is lowered too, since requests are counted with it.
+// It fails with cluster.ErrNotOwner if the owner disagrees about owning the user, or cluster.ErrPeerFailed.
+func (fw *RingFixedWindow) TopUp(userId string, path string, amount int) error {
+	owner, self, ok := fw.Node.Owner(cluster.RingKey(path, userId))
+	if ok && !self {
+		return fw.Node.ForwardTopUp(owner, path, userId, amount)
+	}
+
+	fw.TopUpOwned(userId, path, amount)
+	if !ok {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+
+		if wc, found := fw.local[path][userId]; found && wc.start == fw.currentWindowStart() {
+			wc.count = max(0, wc.count-amount)
+		}
+	}
+	return nil
+}
+
+// ResetOwned clears the request count of a user owned by this gateway.
+func (fw *RingFixedWindow) ResetOwned(userId string, path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if wc, found := fw.owned[path][userId]; found {
+		wc.count = 0
+	}
+}
+
+// TopUpOwned lowers the request count in the current window of a user owned by this gateway.
+func (fw *RingFixedWindow) TopUpOwned(userId string, path string, amount int) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if wc, found := fw.owned[path][userId]; found && wc.start == fw.currentWindowStart() {
+		wc.count = max(0, wc.count-amount)
+	}
+}
+
+// TrackedKeys returns the number of counts kept in memory, owned or local.
+func (fw *RingFixedWindow) TrackedKeys() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return countKeys(fw.owned) + countKeys(fw.local)
+}
+
+// sweep drops the counts of past windows, once per window.
+// The caller must hold the lock.
+func (fw *RingFixedWindow) sweep(windowStart int64) {
+	if fw.swept == windowStart {
+		return
+	}
+	fw.swept = windowStart
+
+	dropPastWindows(fw.owned, windowStart)
+	dropPastWindows(fw.local, windowStart)
+}
+
+// currentWindowStart returns the start of the current window, in Unix seconds.
+func (fw *RingFixedWindow) currentWindowStart() int64 {
+	nowSeconds := time.Now().Unix()
+	return nowSeconds - (nowSeconds % int64(fw.LengthSeconds))
+}
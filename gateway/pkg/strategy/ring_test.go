@@ -0,0 +1,178 @@
+package strategy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gateway/pkg/cluster"
+)
+
+// ringMember is a gateway of a test cluster, with a ring token bucket for every path.
+type ringMember struct {
+	node   *cluster.Node
+	tb     *RingTokenBucket
+	url    string
+	server *http.Server
+}
+
+// newRingPair starts two cluster members and waits until both see the ring with both of them.
+func newRingPair(t *testing.T, capacity int, idleTimeout time.Duration) (*ringMember, *ringMember) {
+	t.Helper()
+
+	listeners := make([]net.Listener, 2)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	members := make([]*ringMember, 2)
+	for i, l := range listeners {
+		m := &ringMember{}
+		peer := listeners[1-i].Addr().String()
+		node, logger := newClusterNode(t, l.Addr().String(), []string{peer}, cluster.Handlers{
+			Merge: func(cluster.Delta) {},
+			Accept: func(path string, userId string, rate float64) (bool, bool) {
+				return m.tb.AcceptOwned(userId, rate, path), true
+			},
+			TopUp: func(path string, userId string, amount int) bool {
+				m.tb.TopUpOwned(userId, path, amount)
+				return true
+			},
+			Reset: func(path string, userId string) bool {
+				m.tb.ResetOwned(userId, path)
+				return true
+			},
+			HandOff: func(path string, userId string) *cluster.KeyState {
+				return m.tb.HandOff(userId, path)
+			},
+		})
+
+		m.node = node
+		m.tb = &RingTokenBucket{Capacity: capacity, Node: node, Logger: logger, IdleTimeout: idleTimeout}
+		m.url = node.Status().URL
+		m.server = &http.Server{Handler: node.Handler()}
+		go m.server.Serve(l)
+		t.Cleanup(func() { m.server.Close() })
+		go node.Run(ctx)
+
+		members[i] = m
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(members[0].node.Status().Ring) != 2 || len(members[1].node.Status().Ring) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the ring wasn't formed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return members[0], members[1]
+}
+
+// ownedBy returns the id of a user owned by a member, for the /foo path.
+func ownedBy(t *testing.T, m *ringMember) string {
+	t.Helper()
+	for i := range 1000 {
+		userId := strconv.Itoa(i)
+		if owner, _, ok := m.node.Owner(cluster.RingKey("/foo", userId)); ok && owner == m.url {
+			return userId
+		}
+	}
+	t.Fatal("no user owned by", m.url)
+	return ""
+}
+
+func TestRingTokenBucketForwards(t *testing.T) {
+	a, b := newRingPair(t, 2, 0)
+	userId := ownedBy(t, b)
+
+	// decided by b, which keeps the bucket
+	expectAcceptUser(t, a.tb, userId, 0.001, true)
+	expectAcceptUser(t, a.tb, userId, 0.001, true)
+	expectAcceptUser(t, a.tb, userId, 0.001, false)
+	if a.tb.TrackedKeys() != 0 || b.tb.TrackedKeys() != 1 {
+		t.Fatalf("tracked keys = %d on a and %d on b, want 0 and 1", a.tb.TrackedKeys(), b.tb.TrackedKeys())
+	}
+
+	// top-ups and resets sent to a are forwarded to b
+	if err := a.tb.TopUp(userId, "/foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	expectAcceptUser(t, a.tb, userId, 0.001, true)
+	expectAcceptUser(t, a.tb, userId, 0.001, false)
+
+	if err := a.tb.Reset(userId, "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	expectAcceptUser(t, b.tb, userId, 0.001, true)
+	expectAcceptUser(t, b.tb, userId, 0.001, true)
+	expectAcceptUser(t, b.tb, userId, 0.001, false)
+}
+
+func TestRingRejectsCallsForUsersNotOwned(t *testing.T) {
+	a, b := newRingPair(t, 2, 0)
+	userId := ownedBy(t, a)
+
+	// as if a saw a ring where b owns the user
+	_, err := a.node.Forward(b.url, "/foo", userId, 1)
+	if !errors.Is(err, cluster.ErrNotOwner) {
+		t.Errorf("forward: err = %v, want %v", err, cluster.ErrNotOwner)
+	}
+	err = a.node.ForwardTopUp(b.url, "/foo", userId, 1)
+	if !errors.Is(err, cluster.ErrNotOwner) {
+		t.Errorf("top-up: err = %v, want %v", err, cluster.ErrNotOwner)
+	}
+	err = a.node.ForwardReset(b.url, "/foo", userId)
+	if !errors.Is(err, cluster.ErrNotOwner) {
+		t.Errorf("reset: err = %v, want %v", err, cluster.ErrNotOwner)
+	}
+	if b.tb.TrackedKeys() != 0 {
+		t.Errorf("tracked keys on b = %d, want 0", b.tb.TrackedKeys())
+	}
+}
+
+func TestRingTokenBucketTopUpOwnerDown(t *testing.T) {
+	a, b := newRingPair(t, 2, 0)
+	userId := ownedBy(t, b)
+
+	// until a sees that b is down, b still owns the user
+	b.server.Close()
+
+	err := a.tb.TopUp(userId, "/foo", 1)
+	if !errors.Is(err, cluster.ErrPeerFailed) || errors.Is(err, cluster.ErrNotOwner) {
+		t.Errorf("top-up: err = %v, want %v", err, cluster.ErrPeerFailed)
+	}
+}
+
+func TestRingTokenBucketDropsIdleBuckets(t *testing.T) {
+	a, b := newRingPair(t, 2, 50*time.Millisecond)
+	full, empty := ownedBy(t, b), ""
+	for i := range 1000 {
+		userId := strconv.Itoa(i)
+		if owner, _, _ := b.node.Owner(cluster.RingKey("/foo", userId)); owner == b.url && userId != full {
+			empty = userId
+			break
+		}
+	}
+
+	// full refills in 50ms, empty doesn't
+	expectAcceptUser(t, a.tb, full, 100, true)
+	expectAcceptUser(t, a.tb, empty, 0.001, true)
+	expectAcceptUser(t, a.tb, empty, 0.001, true)
+
+	time.Sleep(60 * time.Millisecond)
+	expectAcceptUser(t, a.tb, empty, 0.001, false)
+	if keys := b.tb.TrackedKeys(); keys != 1 {
+		t.Errorf("tracked keys on b = %d, want 1: the full bucket dropped", keys)
+	}
+}
@@ -0,0 +1,262 @@
+package strategy
+
+import (
+	"gateway/pkg/cluster"
+	errorlog "gateway/pkg/error-log"
+	"math"
+	"sync"
+	"time"
+)
+
+// RingTokenBucket strategy keeps the token bucket of each user on the cluster member owning the user.
+// The other members forward their requests to the owner. While the owner can't be reached, requests
+// are decided with a local bucket holding the share of the capacity and rate of this gateway.
+// Like ClusterTokenBucket, the bucket of a new user starts full, and full buckets that aren't used
+// for IdleTimeout are dropped.
+type RingTokenBucket struct {
+	Capacity    int
+	Node        *cluster.Node
+	Logger      *errorlog.Logger
+	IdleTimeout time.Duration // 0 keeps idle buckets
+
+	mu        sync.Mutex
+	owned     map[string]map[string]*ringBucket    // path -> userId -> bucket, for the users owned by this gateway
+	local     map[string]map[string]*clusterBucket // path -> userId -> bucket, for the requests decided locally
+	lastSweep time.Time
+}
+
+type ringBucket struct {
+	clusterBucket
+	epoch uint64 // of the ring when the bucket was last used, see cluster.Node.Claim
+}
+
+// Accept forwards the request to the owner of the user, or decides on it if this gateway is the owner.
+func (tb *RingTokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	owner, self, ok := tb.Node.Owner(cluster.RingKey(path, userId))
+	if ok && self {
+		return tb.AcceptOwned(userId, refillRate, path), nil
+	}
+
+	if ok {
+		accepted, err := tb.Node.Forward(owner, path, userId, refillRate)
+		if err == nil {
+			return accepted, nil
+		}
+		tb.Logger.WriteError(err)
+	}
+
+	tb.Node.LocalDecision()
+	return tb.acceptLocal(userId, refillRate, path), nil
+}
+
+// AcceptOwned decides on a request with the bucket of a user owned by this gateway.
+// After a change of the ring, the bucket of a user owned by another member until then is
+// handed off by that member. If it is down, the bucket starts empty at the time of the change,
+// so the requests it granted are not granted again.
+func (tb *RingTokenBucket) AcceptOwned(userId string, refillRate float64, path string) bool {
+	key := cluster.RingKey(path, userId)
+
+	tb.mu.Lock()
+	b, found := tb.owned[path][userId]
+	epoch := uint64(0)
+	if found {
+		epoch = b.epoch
+	}
+	tb.mu.Unlock()
+
+	claim := tb.Node.Claim(key, epoch, found)
+
+	var handedOff *cluster.KeyState
+	if !claim.Trusted && claim.From != "" {
+		state, err := tb.Node.HandOff(claim.From, path, userId)
+		if err != nil {
+			tb.Logger.WriteError(err)
+			claim.From = ""
+		}
+		handedOff = state
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.sweep(now)
+
+	b, found = tb.owned[path][userId]
+	switch {
+	case found && b.epoch == claim.Epoch:
+		// claimed meanwhile by another request
+	case claim.Trusted && found:
+	case claim.Trusted, claim.From != "" && handedOff == nil:
+		b = &ringBucket{clusterBucket: clusterBucket{tokens: float64(tb.Capacity), lastRefill: now}}
+	case claim.From != "":
+		b = &ringBucket{clusterBucket: clusterBucket{tokens: handedOff.Tokens, lastRefill: handedOff.LastRefill}}
+	default:
+		b = &ringBucket{clusterBucket: clusterBucket{tokens: 0, lastRefill: claim.Since}}
+	}
+	b.epoch = claim.Epoch
+	b.rate = refillRate
+	b.refill(now, tb.Capacity)
+
+	if tb.owned == nil {
+		tb.owned = map[string]map[string]*ringBucket{}
+	}
+	if tb.owned[path] == nil {
+		tb.owned[path] = map[string]*ringBucket{}
+	}
+	tb.owned[path][userId] = b
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// HandOff removes the bucket of a user now owned by another member, and returns it.
+func (tb *RingTokenBucket) HandOff(userId string, path string) *cluster.KeyState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b, found := tb.owned[path][userId]
+	if !found {
+		return nil
+	}
+	delete(tb.owned[path], userId)
+
+	b.refill(time.Now(), tb.Capacity)
+	return &cluster.KeyState{Tokens: b.tokens, LastRefill: b.lastRefill}
+}
+
+// acceptLocal decides on a request with a bucket holding the share of this gateway.
+func (tb *RingTokenBucket) acceptLocal(userId string, refillRate float64, path string) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.sweep(now)
+
+	share := tb.Node.Share()
+	capacity := tb.localCapacity()
+
+	if tb.local == nil {
+		tb.local = map[string]map[string]*clusterBucket{}
+	}
+	if tb.local[path] == nil {
+		tb.local[path] = map[string]*clusterBucket{}
+	}
+	b, found := tb.local[path][userId]
+	if !found {
+		b = &clusterBucket{tokens: float64(capacity), lastRefill: now}
+		tb.local[path][userId] = b
+	}
+
+	b.rate = refillRate * share
+	b.refill(now, capacity)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// localCapacity returns the share of the capacity of this gateway, for the requests decided locally.
+func (tb *RingTokenBucket) localCapacity() int {
+	return int(math.Max(1, math.Floor(float64(tb.Capacity)*tb.Node.Share())))
+}
+
+// State returns the tokens left and the last refill time, as of the last request, of a user owned by this gateway.
+// Users without a bucket on this gateway have no tokens and no last refill time.
+func (tb *RingTokenBucket) State(userId string, path string) (State, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	state := State{
+		Path:     path,
+		Strategy: "token_bucket",
+		Capacity: tb.Capacity,
+	}
+
+	if b, found := tb.owned[path][userId]; found {
+		tokens := int(math.Floor(b.tokens))
+		lastRefill := b.lastRefill
+		state.Tokens = &tokens
+		state.LastRefill = &lastRefill
+	}
+
+	return state, nil
+}
+
+// Reset fills the bucket of a user, on the gateway owning the user.
+// It fails with cluster.ErrNotOwner if the owner disagrees about owning the user, or cluster.ErrPeerFailed.
+func (tb *RingTokenBucket) Reset(userId string, path string) error {
+	return tb.TopUp(userId, path, tb.Capacity)
+}
+
+// TopUp adds tokens to the bucket of a user, up to its capacity, on the gateway owning the user.
+// Without a ring, the local bucket is topped up too, since requests are decided with it.
+// It fails with cluster.ErrNotOwner if the owner disagrees about owning the user, or cluster.ErrPeerFailed.
+func (tb *RingTokenBucket) TopUp(userId string, path string, amount int) error {
+	owner, self, ok := tb.Node.Owner(cluster.RingKey(path, userId))
+	if ok && !self {
+		return tb.Node.ForwardTopUp(owner, path, userId, amount)
+	}
+
+	tb.TopUpOwned(userId, path, amount)
+	if !ok {
+		tb.mu.Lock()
+		defer tb.mu.Unlock()
+
+		if b, found := tb.local[path][userId]; found {
+			capacity := tb.localCapacity()
+			b.refill(time.Now(), capacity)
+			b.tokens = min(float64(capacity), b.tokens+float64(amount))
+		}
+	}
+	return nil
+}
+
+// ResetOwned fills the bucket of a user owned by this gateway.
+func (tb *RingTokenBucket) ResetOwned(userId string, path string) {
+	tb.TopUpOwned(userId, path, tb.Capacity)
+}
+
+// TopUpOwned adds tokens to the bucket of a user owned by this gateway, up to its capacity.
+func (tb *RingTokenBucket) TopUpOwned(userId string, path string, amount int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if b, found := tb.owned[path][userId]; found {
+		b.refill(time.Now(), tb.Capacity)
+		b.tokens = min(float64(tb.Capacity), b.tokens+float64(amount))
+	}
+}
+
+// Configure changes the idle timeout.
+func (tb *RingTokenBucket) Configure(idleTimeout time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.IdleTimeout = idleTimeout
+}
+
+// TrackedKeys returns the number of buckets kept in memory, owned or local.
+func (tb *RingTokenBucket) TrackedKeys() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	return countKeys(tb.owned) + countKeys(tb.local)
+}
+
+// sweep drops the idle buckets, at most once per idle timeout. A dropped bucket was full, and a new one starts full,
+// unless the ring changed meanwhile and the previous owner of the user is down.
+// The caller must hold the lock.
+func (tb *RingTokenBucket) sweep(now time.Time) {
+	if tb.IdleTimeout <= 0 || now.Sub(tb.lastSweep) < tb.IdleTimeout {
+		return
+	}
+	tb.lastSweep = now
+
+	dropIdleBuckets(tb.owned, now, tb.IdleTimeout, tb.Capacity)
+	dropIdleBuckets(tb.local, now, tb.IdleTimeout, tb.localCapacity())
+}
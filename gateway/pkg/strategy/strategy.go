@@ -1,6 +1,64 @@
 package strategy
 
+import (
+	"gateway/pkg/cluster"
+	"time"
+)
+
 // LimitStrategy defines the interface for different rate limiting strategies.
 type LimitStrategy interface {
-	Accept(userId string, requestsPerSecond float64, path string) bool
+	// Accept reports whether a request of a user is allowed.
+	// It returns an error, and no decision, if the backend keeping the limiting state failed.
+	Accept(userId string, requestsPerSecond float64, path string) (bool, error)
+}
+
+// Inspector is implemented by strategies whose per-user state can be inspected and changed at runtime.
+type Inspector interface {
+	// State returns the current limiting state of a user for a path.
+	State(userId string, path string) (State, error)
+	// Reset clears the limiting state of a user for a path, so the user is no longer throttled.
+	Reset(userId string, path string) error
+	// TopUp grants a user additional requests for a path.
+	TopUp(userId string, path string, amount int) error
+}
+
+// Merger is implemented by strategies that share their state with the cluster peers.
+type Merger interface {
+	// Merge adds the requests accepted by a peer to the state of a user for a path.
+	// window is the start of the window the requests were counted in, for window strategies.
+	Merge(userId string, path string, window int64, count int)
+}
+
+// RingOwner is implemented by strategies that keep the state of each user on the cluster member owning it.
+type RingOwner interface {
+	// AcceptOwned decides on a request of a user owned by this gateway, e.g. forwarded by another member.
+	AcceptOwned(userId string, requestsPerSecond float64, path string) bool
+	// HandOff removes the state of a user now owned by another member, and returns it, or nil if there is none.
+	HandOff(userId string, path string) *cluster.KeyState
+	// TopUpOwned and ResetOwned change the state of a user owned by this gateway, e.g. for another member.
+	TopUpOwned(userId string, path string, amount int)
+	ResetOwned(userId string, path string)
+}
+
+// KeyTracker is implemented by strategies that keep the state of each user in memory.
+type KeyTracker interface {
+	// TrackedKeys returns the number of users whose state is kept.
+	TrackedKeys() int
+}
+
+// State describes the limiting state of a user for a path.
+// Only the fields relevant to the strategy are set.
+type State struct {
+	Path     string `json:"path"`
+	Strategy string `json:"strategy"`
+
+	// token bucket
+	Tokens     *int       `json:"tokens,omitempty"`
+	Capacity   int        `json:"capacity,omitempty"`
+	LastRefill *time.Time `json:"last_refill,omitempty"`
+
+	// fixed and sliding window
+	WindowStart   *time.Time `json:"window_start,omitempty"`
+	WindowSeconds int        `json:"window_seconds,omitempty"`
+	Count         *int       `json:"count,omitempty"`
 }
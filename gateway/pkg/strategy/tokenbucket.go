@@ -1,45 +1,372 @@
 package strategy
 
 import (
+	"container/list"
+	"expvar"
+	"hash/maphash"
 	"sync"
 	"time"
 )
 
+// tokenBucketMetrics counts the buckets dropped by the in-memory token bucket strategy,
+// published under "token_bucket" at /debug/vars on the admin listener.
+var tokenBucketMetrics = expvar.NewMap("token_bucket")
+
+const (
+	metricIdleEvictions     = "idle_evictions"
+	metricCapacityEvictions = "capacity_evictions"
+	metricCapacityExceeded  = "capacity_exceeded"
+)
+
+// tokenBucketShards is the number of independently locked parts of a TokenBucket.
+// Requests of users in different shards don't wait for each other.
+const tokenBucketShards = 64
+
 // TokenBucket strategy uses in-memory token buckets to limit requests.
+// Buckets are spread over shards by path and user id, each with its own lock.
+// Full buckets that aren't used for IdleTimeout are dropped, which doesn't change the limits:
+// a new bucket starts full. Beyond MaxKeys buckets, the least recently used full bucket of a shard is dropped.
+// Buckets that aren't full are never dropped, since their users would get a full bucket again:
+// if a shard has none that is full, it keeps more than its share of MaxKeys.
 type TokenBucket struct {
-	CurrentTokens map[string]map[string]int // path -> userId -> tokens
-	Capacity      int
-	LastRefill    map[string]map[string]time.Time // path -> userId -> last refill time
-	Created       time.Time
-	Mu            sync.Mutex
+	Capacity    int
+	Created     time.Time
+	IdleTimeout time.Duration // 0 keeps idle buckets
+	MaxKeys     int           // 0 for no maximum
+
+	init   sync.Once
+	seed   maphash.Seed
+	shards [tokenBucketShards]bucketShard
+}
+
+// bucketShard holds the buckets of some of the users of a TokenBucket.
+type bucketShard struct {
+	mu          sync.Mutex
+	buckets     map[bucketKey]*list.Element
+	lru         *list.List // of *bucket, most recently used first
+	lastSweep   time.Time
+	idleTimeout time.Duration
+	maxKeys     int // share of TokenBucket.MaxKeys, -1 for no maximum
+}
+
+type bucketKey struct {
+	path   string
+	userId string
+}
+
+type bucket struct {
+	key        bucketKey
+	tokens     int
+	lastRefill time.Time
+	rate       float64 // refill rate of the last request
 }
 
 // Accept refills the bucket lazily, based on the elapsed time since the last refill.
 // If a token is available, it is consumed and the request is accepted.
-func (tb *TokenBucket) Accept(userId string, refillRate float64, path string) bool {
-	tb.Mu.Lock()
-	defer tb.Mu.Unlock()
+func (tb *TokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	shard := tb.shard(path, userId)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	shard.sweep(now, tb.Capacity)
+
+	b := shard.bucket(bucketKey{path: path, userId: userId})
+	added := b == nil
+	if added {
+		b = &bucket{key: bucketKey{path: path, userId: userId}, lastRefill: tb.Created}
+		shard.add(b)
+	}
+
+	b.rate = refillRate
+	b.refill(now, tb.Capacity)
+
+	accepted := b.tokens > 0
+	if accepted {
+		b.tokens--
+	}
+	if added {
+		shard.evict(now, tb.Capacity)
+	}
+
+	return accepted, nil
+}
+
+// State returns the tokens left now, refilled at the rate of the last request, and the last refill time.
+// Users that haven't made any request yet, or whose bucket was dropped, have no tokens and no last refill time.
+func (tb *TokenBucket) State(userId string, path string) (State, error) {
+	shard := tb.shard(path, userId)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	state := State{
+		Path:     path,
+		Strategy: "token_bucket",
+		Capacity: tb.Capacity,
+	}
+
+	if elem, found := shard.buckets[bucketKey{path: path, userId: userId}]; found {
+		b := *elem.Value.(*bucket)
+		b.refill(time.Now(), tb.Capacity)
+		tokens, lastRefill := b.tokens, b.lastRefill
+		state.Tokens = &tokens
+		state.LastRefill = &lastRefill
+	}
+
+	return state, nil
+}
+
+// Reset fills the bucket of a user.
+func (tb *TokenBucket) Reset(userId string, path string) error {
+	tb.setTokens(userId, path, func(int) int { return tb.Capacity })
+	return nil
+}
+
+// TopUp adds tokens to the bucket of a user, up to its capacity.
+func (tb *TokenBucket) TopUp(userId string, path string, amount int) error {
+	tb.setTokens(userId, path, func(tokens int) int { return min(tb.Capacity, tokens+amount) })
+	return nil
+}
+
+// Configure changes the idle timeout and the maximum number of buckets.
+// If there are more buckets than the new maximum, the least recently used full ones are dropped.
+func (tb *TokenBucket) Configure(idleTimeout time.Duration, maxKeys int) {
+	tb.setup()
+
+	now := time.Now()
+	for i := range tb.shards {
+		shard := &tb.shards[i]
+		shard.mu.Lock()
+		shard.configure(i, idleTimeout, maxKeys)
+		shard.evict(now, tb.Capacity)
+		shard.mu.Unlock()
+	}
+}
+
+// TrackedKeys returns the number of buckets kept in memory.
+func (tb *TokenBucket) TrackedKeys() int {
+	tb.setup()
+
+	keys := 0
+	for i := range tb.shards {
+		shard := &tb.shards[i]
+		shard.mu.Lock()
+		keys += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return keys
+}
+
+// BucketSnapshot is the state of the buckets of a TokenBucket, saved so it can be restored after a restart.
+type BucketSnapshot struct {
+	Capacity int           `json:"capacity"`
+	Created  time.Time     `json:"created"`
+	Buckets  []BucketState `json:"buckets"`
+}
+
+// BucketState is the state of the bucket of a user, as of their last request.
+type BucketState struct {
+	Path       string    `json:"path"`
+	UserId     string    `json:"user_id"`
+	Tokens     int       `json:"tokens"`
+	LastRefill time.Time `json:"last_refill"`
+	Rate       float64   `json:"rate"`
+}
+
+// Snapshot returns the state of every bucket.
+func (tb *TokenBucket) Snapshot() BucketSnapshot {
+	tb.setup()
 
-	if _, found := tb.LastRefill[path][userId]; !found {
-		if tb.LastRefill[path] == nil {
-			tb.LastRefill[path] = map[string]time.Time{}
+	snapshot := BucketSnapshot{Capacity: tb.Capacity, Created: tb.Created, Buckets: []BucketState{}}
+	for i := range tb.shards {
+		shard := &tb.shards[i]
+		shard.mu.Lock()
+		// least recently used first, so restoring the buckets in order keeps their order
+		for elem := shard.lru.Back(); elem != nil; elem = elem.Prev() {
+			b := elem.Value.(*bucket)
+			snapshot.Buckets = append(snapshot.Buckets, BucketState{
+				Path:       b.key.path,
+				UserId:     b.key.userId,
+				Tokens:     b.tokens,
+				LastRefill: b.lastRefill,
+				Rate:       b.rate,
+			})
 		}
-		tb.LastRefill[path][userId] = tb.Created
+		shard.mu.Unlock()
 	}
+	return snapshot
+}
+
+// Restore replaces the buckets with the ones of a snapshot, and the creation time with the one of the snapshot.
+// The buckets refill from their last refill time on the next request, so the time since the snapshot is applied.
+// Tokens beyond the capacity, if it was lowered since, are dropped.
+// It must be called before the TokenBucket is used.
+func (tb *TokenBucket) Restore(snapshot BucketSnapshot) {
+	tb.setup()
+
+	if !snapshot.Created.IsZero() {
+		tb.Created = snapshot.Created
+	}
+
 	now := time.Now()
+	for _, state := range snapshot.Buckets {
+		shard := tb.shard(state.Path, state.UserId)
+		shard.mu.Lock()
+
+		key := bucketKey{path: state.Path, userId: state.UserId}
+		if elem, found := shard.buckets[key]; found {
+			shard.remove(elem)
+		}
+		shard.add(&bucket{
+			key:        key,
+			tokens:     min(tb.Capacity, state.Tokens),
+			lastRefill: state.LastRefill,
+			rate:       state.Rate,
+		})
+		shard.evict(now, tb.Capacity)
+
+		shard.mu.Unlock()
+	}
+}
+
+// setTokens refills the bucket of a user up to now, then changes its tokens.
+// A user without a bucket has no known rate yet: the new bucket keeps refilling from the creation time,
+// like any new bucket, on the next request, so the change adds to what the user earned until then.
+func (tb *TokenBucket) setTokens(userId string, path string, tokens func(int) int) {
+	shard := tb.shard(path, userId)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	b := shard.bucket(bucketKey{path: path, userId: userId})
+	if b != nil {
+		b.refill(now, tb.Capacity)
+		b.tokens = tokens(b.tokens)
+		return
+	}
+
+	b = &bucket{key: bucketKey{path: path, userId: userId}, lastRefill: tb.Created}
+	shard.add(b)
+	b.tokens = tokens(b.tokens)
+	shard.evict(now, tb.Capacity)
+}
+
+// refill adds the tokens earned at the rate of the last request since the last refill, up to the capacity.
+func (b *bucket) refill(now time.Time, capacity int) {
+	refillTokens := int(now.Sub(b.lastRefill).Seconds() * b.rate)
+	b.tokens = min(capacity, b.tokens+refillTokens)
+	b.lastRefill = now
+}
+
+// full reports whether the bucket would be full if refilled now, so dropping it doesn't change the limits.
+func (b *bucket) full(now time.Time, capacity int) bool {
+	return b.tokens+int(now.Sub(b.lastRefill).Seconds()*b.rate) >= capacity
+}
+
+// shard returns the shard holding the bucket of a user.
+func (tb *TokenBucket) shard(path string, userId string) *bucketShard {
+	tb.setup()
+
+	var h maphash.Hash
+	h.SetSeed(tb.seed)
+	h.WriteString(path)
+	h.WriteByte(0)
+	h.WriteString(userId)
+	return &tb.shards[h.Sum64()%tokenBucketShards]
+}
 
-	elapsedSeconds := now.Sub(tb.LastRefill[path][userId]).Seconds()
-	refillTokens := int(elapsedSeconds * refillRate)
-	if tb.CurrentTokens[path] == nil {
-		tb.CurrentTokens[path] = map[string]int{}
+// setup initializes the shards on first use, with the settings of the TokenBucket.
+func (tb *TokenBucket) setup() {
+	tb.init.Do(func() {
+		tb.seed = maphash.MakeSeed()
+		for i := range tb.shards {
+			tb.shards[i].buckets = map[bucketKey]*list.Element{}
+			tb.shards[i].lru = list.New()
+			tb.shards[i].configure(i, tb.IdleTimeout, tb.MaxKeys)
+		}
+	})
+}
+
+// configure sets the idle timeout and the share of the maximum number of buckets of the i-th shard.
+// The shares add up to maxKeys: with fewer than tokenBucketShards, some shards keep no full bucket.
+// The caller must hold the lock of the shard.
+func (s *bucketShard) configure(i int, idleTimeout time.Duration, maxKeys int) {
+	s.idleTimeout = idleTimeout
+	if maxKeys <= 0 {
+		s.maxKeys = -1
+		return
+	}
+	s.maxKeys = maxKeys / tokenBucketShards
+	if i < maxKeys%tokenBucketShards {
+		s.maxKeys++
+	}
+}
+
+// bucket returns the bucket of a key and marks it as the most recently used, or nil if there is none.
+// The caller must hold the lock of the shard.
+func (s *bucketShard) bucket(key bucketKey) *bucket {
+	elem, found := s.buckets[key]
+	if !found {
+		return nil
 	}
-	tb.CurrentTokens[path][userId] = min(tb.Capacity, tb.CurrentTokens[path][userId]+refillTokens)
-	tb.LastRefill[path][userId] = now
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*bucket)
+}
+
+// add adds a bucket as the most recently used. The caller must hold the lock of the shard,
+// and call evict once the bucket is used, so it is judged on its tokens after the request.
+func (s *bucketShard) add(b *bucket) {
+	s.buckets[b.key] = s.lru.PushFront(b)
+}
 
-	if tb.CurrentTokens[path][userId] > 0 {
-		tb.CurrentTokens[path][userId]--
-		return true
+// evict drops the least recently used full buckets until there are at most maxKeys.
+// If there are still more, none of them is full: they are kept and counted as exceeding the capacity.
+// The caller must hold the lock of the shard.
+func (s *bucketShard) evict(now time.Time, capacity int) {
+	if s.maxKeys < 0 {
+		return
 	}
 
-	return false
+	for elem := s.lru.Back(); elem != nil && s.lru.Len() > s.maxKeys; {
+		prev := elem.Prev()
+		if elem.Value.(*bucket).full(now, capacity) {
+			s.remove(elem)
+			tokenBucketMetrics.Add(metricCapacityEvictions, 1)
+		}
+		elem = prev
+	}
+	if s.lru.Len() > s.maxKeys {
+		tokenBucketMetrics.Add(metricCapacityExceeded, 1)
+	}
+}
+
+// sweep drops the full buckets that haven't been used for the idle timeout.
+// It walks the buckets from the least recently used, at most once per idle timeout.
+// The caller must hold the lock of the shard.
+func (s *bucketShard) sweep(now time.Time, capacity int) {
+	if s.idleTimeout <= 0 || now.Sub(s.lastSweep) < s.idleTimeout {
+		return
+	}
+	s.lastSweep = now
+
+	for elem := s.lru.Back(); elem != nil; {
+		b := elem.Value.(*bucket)
+		idle := now.Sub(b.lastRefill)
+		if idle < s.idleTimeout {
+			break
+		}
+
+		prev := elem.Prev()
+		if b.full(now, capacity) {
+			s.remove(elem)
+			tokenBucketMetrics.Add(metricIdleEvictions, 1)
+		}
+		elem = prev
+	}
+}
+
+// remove drops a bucket. The caller must hold the lock of the shard.
+func (s *bucketShard) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.buckets, elem.Value.(*bucket).key)
 }
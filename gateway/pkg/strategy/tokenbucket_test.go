@@ -0,0 +1,213 @@
+package strategy
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketMaxKeysDropsFullBuckets(t *testing.T) {
+	// fewer than one bucket per shard
+	tb := &TokenBucket{Capacity: 2, Created: time.Now().Add(-time.Hour), MaxKeys: 10}
+
+	// refilled within a nanosecond, but not yet when added
+	for i := range 1000 {
+		expectAcceptUser(t, tb, strconv.Itoa(i), 1e9, true)
+	}
+	if keys := tb.TrackedKeys(); keys > tokenBucketShards {
+		t.Errorf("tracked keys = %d, want at most one bucket beyond the share of each shard", keys)
+	}
+
+	time.Sleep(time.Millisecond)
+	tb.Configure(0, 10)
+	if keys := tb.TrackedKeys(); keys != 10 {
+		t.Errorf("tracked keys = %d, want 10", keys)
+	}
+}
+
+func TestTokenBucketMaxKeysKeepsBucketsNotFull(t *testing.T) {
+	tb := &TokenBucket{Capacity: 2, Created: time.Now().Add(-time.Hour), MaxKeys: 10}
+
+	for i := range 100 {
+		expectAcceptUser(t, tb, strconv.Itoa(i), 0.001, true)
+	}
+	if keys := tb.TrackedKeys(); keys != 100 {
+		t.Errorf("tracked keys = %d, want 100: buckets with a token taken dropped", keys)
+	}
+
+	// no user got a full bucket again
+	for i := range 100 {
+		expectAcceptUser(t, tb, strconv.Itoa(i), 0.001, true)
+		expectAcceptUser(t, tb, strconv.Itoa(i), 0.001, false)
+	}
+}
+
+// lockedTokenBucket is the token bucket before sharding, with a single lock and no eviction,
+// to check that the shards don't change which requests are accepted.
+type lockedTokenBucket struct {
+	capacity int
+	created  time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+func (tb *lockedTokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	key := bucketKey{path: path, userId: userId}
+	b, found := tb.buckets[key]
+	if !found {
+		b = &bucket{key: key, lastRefill: tb.created}
+		tb.buckets[key] = b
+	}
+
+	b.rate = refillRate
+	b.refill(time.Now(), tb.capacity)
+	if b.tokens > 0 {
+		b.tokens--
+		return true, nil
+	}
+	return false, nil
+}
+
+func (tb *lockedTokenBucket) TopUp(userId string, path string, amount int) error {
+	tb.setTokens(userId, path, func(tokens int) int { return min(tb.capacity, tokens+amount) })
+	return nil
+}
+
+func (tb *lockedTokenBucket) Reset(userId string, path string) error {
+	tb.setTokens(userId, path, func(int) int { return tb.capacity })
+	return nil
+}
+
+// setTokens changes the tokens like TokenBucket.setTokens: a new bucket refills from the creation time on the next request.
+func (tb *lockedTokenBucket) setTokens(userId string, path string, tokens func(int) int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	key := bucketKey{path: path, userId: userId}
+	b, found := tb.buckets[key]
+	if found {
+		b.refill(time.Now(), tb.capacity)
+	} else {
+		b = &bucket{key: key, lastRefill: tb.created}
+		tb.buckets[key] = b
+	}
+	b.tokens = tokens(b.tokens)
+}
+
+// Requests are made at rates where no token is earned during the test,
+// and the tokens earned since the creation of the buckets are far from a whole number.
+var equivalenceRates = []float64{0.0004, 0.0011, 0.0025}
+
+func TestTokenBucketShardsAcceptLikeSingleLock(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	sharded := &TokenBucket{Capacity: 5, Created: created}
+	locked := &lockedTokenBucket{capacity: 5, created: created, buckets: map[bucketKey]*bucket{}}
+
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := range 20000 {
+		userId, path := strconv.Itoa(random.IntN(200)), []string{"/foo", "/bar"}[random.IntN(2)]
+		switch op := random.IntN(20); {
+		case op == 0:
+			sharded.TopUp(userId, path, 2)
+			locked.TopUp(userId, path, 2)
+		case op == 1:
+			sharded.Reset(userId, path)
+			locked.Reset(userId, path)
+		default:
+			rate := equivalenceRates[random.IntN(len(equivalenceRates))]
+			got, _ := sharded.Accept(userId, rate, path)
+			want, _ := locked.Accept(userId, rate, path)
+			if got != want {
+				t.Fatalf("request %d of user %s on %s: accepted = %v, want %v", i, userId, path, got, want)
+			}
+		}
+	}
+}
+
+func TestTokenBucketShardsAcceptLikeSingleLockConcurrently(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	sharded := &TokenBucket{Capacity: 5, Created: created}
+	locked := &lockedTokenBucket{capacity: 5, created: created, buckets: map[bucketKey]*bucket{}}
+
+	// every goroutine makes 2 requests for each user: how many are accepted doesn't depend on their order
+	const users, goroutines = 500, 8
+	var accepted [users]atomic.Int32
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 2 * users {
+				user := (i/2 + g*users/goroutines) % users
+				ok, _ := sharded.Accept(strconv.Itoa(user), equivalenceRates[user%len(equivalenceRates)], "/foo")
+				if ok {
+					accepted[user].Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for user := range users {
+		want := 0
+		for range 2 * goroutines {
+			if ok, _ := locked.Accept(strconv.Itoa(user), equivalenceRates[user%len(equivalenceRates)], "/foo"); ok {
+				want++
+			}
+		}
+		if got := int(accepted[user].Load()); got != want {
+			t.Errorf("user %d: %d requests accepted, want %d", user, got, want)
+		}
+	}
+}
+
+// globalLockTokenBucket serializes the requests of all users, like the token bucket before sharding,
+// with the same work per request.
+type globalLockTokenBucket struct {
+	mu sync.Mutex
+	tb *TokenBucket
+}
+
+func (g *globalLockTokenBucket) Accept(userId string, refillRate float64, path string) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tb.Accept(userId, refillRate, path)
+}
+
+// BenchmarkTokenBucketAccept compares the shards with a single lock, for requests of many users in parallel.
+// Run it with -cpu to see the contention grow with the number of goroutines.
+func BenchmarkTokenBucketAccept(b *testing.B) {
+	const users = 10000
+	userIds := make([]string, users)
+	for i := range userIds {
+		userIds[i] = strconv.Itoa(i)
+	}
+
+	strategies := []struct {
+		name string
+		tb   acceptor
+	}{
+		{"sharded", &TokenBucket{Capacity: 100, Created: time.Now()}},
+		{"single_lock", &globalLockTokenBucket{tb: &TokenBucket{Capacity: 100, Created: time.Now()}}},
+	}
+	for _, s := range strategies {
+		b.Run(s.name, func(b *testing.B) {
+			// each goroutine starts at a different user
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(997))
+				for pb.Next() {
+					i++
+					s.tb.Accept(userIds[i%users], 1000, "/foo")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package userdata
+
+import "errors"
+
+var (
+	ErrInvalidName   = errors.New("name must not be empty")
+	ErrInvalidQuota  = errors.New("quota must be > 0")
+	ErrInvalidRate   = errors.New("rate must be > 0, or a plan must be given")
+	ErrDuplicatePlan = errors.New("duplicate plan")
+	ErrDuplicateUser = errors.New("duplicate user id")
+	ErrUnknownPlan   = errors.New("unknown plan")
+	ErrUnknownFormat = errors.New("format must be csv or json")
+	ErrCSVHeader     = errors.New("invalid csv header")
+)
@@ -0,0 +1,177 @@
+package userdata
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+var (
+	userColumns = []string{"id", "name", "rate", "plan", "suspended"}
+	planColumns = []string{"name", "quota"}
+)
+
+// ReadJSON reads plans and users from a JSON document like
+// {"plans": [{"name": "free", "quota": 0.5}], "users": [{"id": 1, "name": "Ionel", "plan": "free"}]}
+func ReadJSON(r io.Reader) (*Data, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	data := &Data{}
+	if err := decoder.Decode(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteJSON writes plans and users in the format read by ReadJSON.
+func WriteJSON(w io.Writer, data *Data) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// ReadCSV reads either users or plans from a CSV file with a header line.
+// Files with a quota column hold plans, with the columns name and quota.
+// Other files hold users, with the columns id, name, rate, plan and suspended,
+// in any order. Only name is required. Empty cells take the default value.
+func ReadCSV(r io.Reader) (*Data, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCSVHeader, err)
+	}
+
+	columns := planColumns
+	if !slices.Contains(header, "quota") {
+		columns = userColumns
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		if !slices.Contains(columns, name) {
+			return nil, fmt.Errorf("%w: unknown column %q", ErrCSVHeader, name)
+		}
+		index[name] = i
+	}
+	if _, found := index["name"]; !found {
+		return nil, fmt.Errorf("%w: missing column \"name\"", ErrCSVHeader)
+	}
+
+	data := &Data{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		cell := func(name string) string {
+			if i, found := index[name]; found {
+				return record[i]
+			}
+			return ""
+		}
+
+		if slices.Equal(columns, planColumns) {
+			p, err := parsePlan(cell)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			data.Plans = append(data.Plans, p)
+			continue
+		}
+
+		u, err := parseUser(cell)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		data.Users = append(data.Users, u)
+	}
+}
+
+// WriteUsersCSV writes users in the format read by ReadCSV.
+func WriteUsersCSV(w io.Writer, users []User) error {
+	writer := csv.NewWriter(w)
+	writer.Write(userColumns)
+
+	for _, u := range users {
+		id := ""
+		if u.Id != nil {
+			id = strconv.FormatInt(*u.Id, 10)
+		}
+		writer.Write([]string{
+			id,
+			u.Name,
+			strconv.FormatFloat(u.Rate, 'f', -1, 64),
+			u.Plan,
+			strconv.FormatBool(u.Suspended),
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WritePlansCSV writes plans in the format read by ReadCSV.
+func WritePlansCSV(w io.Writer, plans []Plan) error {
+	writer := csv.NewWriter(w)
+	writer.Write(planColumns)
+
+	for _, p := range plans {
+		writer.Write([]string{p.Name, strconv.FormatFloat(p.Quota, 'f', -1, 64)})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func parsePlan(cell func(string) string) (Plan, error) {
+	p := Plan{Name: cell("name")}
+
+	quota, err := strconv.ParseFloat(cell("quota"), 64)
+	if err != nil {
+		return p, fmt.Errorf("quota: %w", err)
+	}
+	p.Quota = quota
+
+	return p, nil
+}
+
+func parseUser(cell func(string) string) (User, error) {
+	u := User{Name: cell("name"), Plan: cell("plan")}
+
+	if id := cell("id"); id != "" {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return u, fmt.Errorf("id: %w", err)
+		}
+		u.Id = &n
+	}
+
+	if rate := cell("rate"); rate != "" {
+		n, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return u, fmt.Errorf("rate: %w", err)
+		}
+		u.Rate = n
+	}
+
+	if suspended := cell("suspended"); suspended != "" {
+		b, err := strconv.ParseBool(suspended)
+		if err != nil {
+			return u, fmt.Errorf("suspended: %w", err)
+		}
+		u.Suspended = b
+	}
+
+	return u, nil
+}
@@ -0,0 +1,313 @@
+// Package userdata imports and exports the users and plans tables.
+package userdata
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gateway/pkg/storage"
+	"strconv"
+	"time"
+)
+
+// Plan is a named quota. Users assigned to a plan get its current quota,
+// unless their rate is given explicitly, so changing the quota of a plan changes the rate of its users.
+type Plan struct {
+	Name  string  `json:"name"`
+	Quota float64 `json:"quota"`
+}
+
+// User is a row of the users table. A nil Id lets the database assign one.
+type User struct {
+	Id        *int64  `json:"id,omitempty"`
+	Name      string  `json:"name"`
+	Rate      float64 `json:"rate,omitempty"` // 0 follows the quota of the plan
+	Plan      string  `json:"plan,omitempty"`
+	Suspended bool    `json:"suspended"`
+}
+
+// Data holds the plans and users read from, or written to, a file.
+type Data struct {
+	Plans []Plan `json:"plans"`
+	Users []User `json:"users"`
+}
+
+// Change actions reported by Import.
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+)
+
+// Change describes what Import did, or would do in a dry run, to one row.
+type Change struct {
+	Kind   string   `json:"kind"` // plan or user
+	Key    string   `json:"key"`  // plan name or user id
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"` // changed columns, for updates
+}
+
+// Import upserts the plans, then the users, in a single transaction.
+// Plans are matched by name and users by id. Users without an id are created.
+// In a dry run, the changes are computed the same way and then rolled back.
+func Import(ctx context.Context, store *storage.Store, data *Data, dryRun bool) ([]Change, error) {
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := store.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changes := []Change{}
+
+	for _, p := range data.Plans {
+		change, err := upsertPlan(ctx, store, tx, p)
+		if err != nil {
+			return nil, fmt.Errorf("plan %q: %w", p.Name, err)
+		}
+		changes = append(changes, change)
+	}
+
+	for _, u := range data.Users {
+		change, err := upsertUser(ctx, store, tx, u)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.describe(), err)
+		}
+		changes = append(changes, change)
+
+		if change.Action != ActionUnchanged {
+			if err := store.LogUserChange(ctx, tx, change.Key); err != nil {
+				return nil, fmt.Errorf("user %s: %w", u.describe(), err)
+			}
+		}
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+	return changes, tx.Commit()
+}
+
+// Export reads every plan and user, ordered by plan name and user id.
+func Export(ctx context.Context, store *storage.Store) (*Data, error) {
+	db := store.DB()
+	data := &Data{Plans: []Plan{}, Users: []User{}}
+
+	rows, err := db.QueryContext(ctx, `SELECT name, quota FROM plans ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Plan
+		if err := rows.Scan(&p.Name, &p.Quota); err != nil {
+			return nil, err
+		}
+		data.Plans = append(data.Plans, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT id, name, quota, plan, suspended FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		var id int64
+		if err := rows.Scan(&id, &u.Name, &u.Rate, &u.Plan, &u.Suspended); err != nil {
+			return nil, err
+		}
+		u.Id = &id
+		data.Users = append(data.Users, u)
+	}
+
+	return data, rows.Err()
+}
+
+// Validate checks every plan and user, and reports all the problems found.
+func (d *Data) Validate() error {
+	var errs []error
+
+	plans := map[string]bool{}
+	for _, p := range d.Plans {
+		switch {
+		case p.Name == "":
+			errs = append(errs, fmt.Errorf("plan: %w", ErrInvalidName))
+		case plans[p.Name]:
+			errs = append(errs, fmt.Errorf("plan %q: %w", p.Name, ErrDuplicatePlan))
+		case p.Quota <= 0:
+			errs = append(errs, fmt.Errorf("plan %q: %w", p.Name, ErrInvalidQuota))
+		}
+		plans[p.Name] = true
+	}
+
+	ids := map[int64]bool{}
+	for _, u := range d.Users {
+		switch {
+		case u.Name == "":
+			errs = append(errs, fmt.Errorf("user %s: %w", u.describe(), ErrInvalidName))
+		case u.Id != nil && ids[*u.Id]:
+			errs = append(errs, fmt.Errorf("user %s: %w", u.describe(), ErrDuplicateUser))
+		case u.Rate < 0, u.Rate == 0 && u.Plan == "":
+			errs = append(errs, fmt.Errorf("user %s: %w", u.describe(), ErrInvalidRate))
+		}
+		if u.Id != nil {
+			ids[*u.Id] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func upsertPlan(ctx context.Context, store *storage.Store, tx *sql.Tx, p Plan) (Change, error) {
+	change := Change{Kind: "plan", Key: p.Name, Action: ActionCreate}
+
+	var quota float64
+	err := tx.QueryRowContext(ctx, store.Rebind(`SELECT quota FROM plans WHERE name = ?`), p.Name).Scan(&quota)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return change, err
+	case quota == p.Quota:
+		change.Action = ActionUnchanged
+		return change, nil
+	default:
+		change.Action = ActionUpdate
+		change.Fields = []string{"quota"}
+	}
+
+	_, err = tx.ExecContext(ctx, store.Rebind(`
+	INSERT INTO plans (name, quota) VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET quota = excluded.quota`),
+		p.Name, p.Quota,
+	)
+	if err != nil || change.Action != ActionUpdate {
+		return change, err
+	}
+
+	// the rate of the users following the plan changed, so the gateways must drop them from their caches
+	return change, logPlanUsers(ctx, store, tx, p.Name)
+}
+
+// logPlanUsers records a change for every user following the quota of a plan.
+func logPlanUsers(ctx context.Context, store *storage.Store, tx *sql.Tx, plan string) error {
+	rows, err := tx.QueryContext(ctx, store.Rebind(`SELECT id FROM users WHERE plan = ? AND quota = 0`), plan)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := store.LogUserChange(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upsertUser(ctx context.Context, store *storage.Store, tx *sql.Tx, u User) (Change, error) {
+	change := Change{Kind: "user", Action: ActionCreate}
+
+	// a rate of 0 is kept, so the user follows the quota of the plan
+	if u.Plan != "" {
+		var exists int
+		err := tx.QueryRowContext(ctx, store.Rebind(`SELECT 1 FROM plans WHERE name = ?`), u.Plan).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return change, fmt.Errorf("%w: %s", ErrUnknownPlan, u.Plan)
+		}
+		if err != nil {
+			return change, err
+		}
+	}
+
+	if u.Id == nil {
+		// a new user, with the next free id
+		created := storage.User{Name: u.Name, Rate: u.Rate, Plan: u.Plan, Suspended: u.Suspended}
+		if err := store.InsertUser(ctx, tx, &created); err != nil {
+			return change, err
+		}
+		change.Key = strconv.FormatInt(created.Id, 10)
+		return change, nil
+	}
+
+	change.Key = strconv.FormatInt(*u.Id, 10)
+
+	var existing User
+	err := tx.QueryRowContext(ctx, store.Rebind(`
+	SELECT name, quota, plan, suspended FROM users WHERE id = ?`),
+		*u.Id,
+	).Scan(&existing.Name, &existing.Rate, &existing.Plan, &existing.Suspended)
+
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return change, err
+	default:
+		change.Fields = existing.diff(u)
+		if len(change.Fields) == 0 {
+			change.Action = ActionUnchanged
+			return change, nil
+		}
+		change.Action = ActionUpdate
+	}
+
+	_, err = tx.ExecContext(ctx, store.Rebind(`
+	INSERT INTO users (id, name, quota, plan, suspended, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		name = excluded.name,
+		quota = excluded.quota,
+		plan = excluded.plan,
+		suspended = excluded.suspended`),
+		*u.Id, u.Name, u.Rate, u.Plan, u.Suspended, time.Now().UTC().Format(time.RFC3339),
+	)
+	return change, err
+}
+
+// diff returns the columns that differ between two users.
+func (u User) diff(other User) []string {
+	var fields []string
+	if u.Name != other.Name {
+		fields = append(fields, "name")
+	}
+	if u.Rate != other.Rate {
+		fields = append(fields, "rate")
+	}
+	if u.Plan != other.Plan {
+		fields = append(fields, "plan")
+	}
+	if u.Suspended != other.Suspended {
+		fields = append(fields, "suspended")
+	}
+	return fields
+}
+
+// describe identifies a user in error messages, by id if it has one.
+func (u User) describe() string {
+	if u.Id != nil {
+		return strconv.FormatInt(*u.Id, 10)
+	}
+	return strconv.Quote(u.Name)
+}
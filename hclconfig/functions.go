@@ -0,0 +1,71 @@
+// Package hclconfig holds what the HCL configurations of the gateway and api modules share:
+// the functions available in the files and the Secret type.
+package hclconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// EvalContext returns the functions available in configuration files:
+//   - env(name) returns an environment variable, failing if it is not set
+//   - env(name, default) returns an environment variable, or default if it is not set or empty
+//   - file(path) returns the content of a file without the trailing newline, for reading secrets
+//
+// Relative file paths are resolved against dir, the directory of the configuration file.
+func EvalContext(dir string) *hcl.EvalContext {
+	return &hcl.EvalContext{
+		Functions: map[string]function.Function{
+			"env":  envFunc,
+			"file": fileFunc(dir),
+		},
+	}
+}
+
+var envFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "name", Type: cty.String},
+	},
+	VarParam: &function.Parameter{Name: "default", Type: cty.String},
+	Type:     function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		if len(args) > 2 {
+			return cty.NilVal, fmt.Errorf("env takes a name and an optional default value")
+		}
+
+		name := args[0].AsString()
+		if value := os.Getenv(name); value != "" {
+			return cty.StringVal(value), nil
+		}
+		if len(args) == 2 {
+			return args[1], nil
+		}
+		return cty.NilVal, fmt.Errorf("environment variable %s is not set", name)
+	},
+})
+
+func fileFunc(dir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+			path := args[0].AsString()
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return cty.NilVal, err
+			}
+			return cty.StringVal(strings.TrimRight(string(content), "\r\n")), nil
+		},
+	})
+}
@@ -0,0 +1,66 @@
+package hclconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+)
+
+type fileConf struct {
+	Relative string `hcl:"relative"`
+	Absolute string `hcl:"absolute"`
+}
+
+func TestFileIsRelativeToConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "secrets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secrets", "key"), []byte("relative\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	absolute := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(absolute, []byte("absolute\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the working directory is the package directory, which has no secrets/key
+	src := []byte(`
+relative = file("secrets/key")
+absolute = file("` + filepath.ToSlash(absolute) + `")
+`)
+	var conf fileConf
+	if err := hclsimple.Decode("gateway.hcl", src, EvalContext(dir), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Relative != "relative" {
+		t.Errorf("relative = %q, want %q", conf.Relative, "relative")
+	}
+	if conf.Absolute != "absolute" {
+		t.Errorf("absolute = %q, want %q", conf.Absolute, "absolute")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("HCLCONFIG_SET", "value")
+	t.Setenv("HCLCONFIG_EMPTY", "")
+
+	src := []byte(`
+relative = env("HCLCONFIG_SET")
+absolute = env("HCLCONFIG_EMPTY", "default")
+`)
+	var conf fileConf
+	if err := hclsimple.Decode("gateway.hcl", src, EvalContext("."), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Relative != "value" || conf.Absolute != "default" {
+		t.Errorf("got %q and %q, want value and default", conf.Relative, conf.Absolute)
+	}
+
+	if err := hclsimple.Decode("gateway.hcl", []byte(`relative = env("HCLCONFIG_UNSET")
+absolute = ""`), EvalContext("."), &conf); err == nil {
+		t.Error("env of an unset variable without default succeeded")
+	}
+}
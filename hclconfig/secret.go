@@ -0,0 +1,24 @@
+package hclconfig
+
+// Secret is a configuration value that must not be logged or dumped.
+// It is redacted when formatted or encoded, Reveal returns the actual value.
+type Secret string
+
+const redacted = "[redacted]"
+
+// Reveal returns the secret value.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return redacted
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}